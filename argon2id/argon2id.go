@@ -3,12 +3,17 @@
 package argon2id
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/argon2"
 )
@@ -23,6 +28,10 @@ import (
 // not match.
 var ErrMismatchedHashAndPassword = errors.New("argon2id: hashedPassword is not the hash of the given password")
 
+// ErrInvalidHash is wrapped by errors returned when a hashed password is not
+// in the PHC string format of argon2id, e.g. because the stored hash is corrupted.
+var ErrInvalidHash = errors.New("argon2id: invalid hash")
+
 // Parameter represents input parameters of Argon2id.
 // For parameter choice, see https://www.rfc-editor.org/rfc/rfc9106.html#name-parameter-choice.
 // According to RFC 9106, the FIRST RECOMMENDED option is
@@ -47,6 +56,61 @@ type Parameter struct {
 	SaltLength uint32
 }
 
+// MarshalText implements [encoding.TextMarshaler].
+// It returns the parameters in the format of the PHC string,
+// extended with the key and salt lengths, e.g. "m=65536,t=3,p=4,T=32,S=16".
+func (p Parameter) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "m=%d,t=%d,p=%d,T=%d,S=%d",
+		p.Memory, p.Time, p.Parallelism, p.KeyLength, p.SaltLength), nil
+}
+
+// UnmarshalText implements [encoding.TextUnmarshaler].
+// It parses the format returned by MarshalText.
+func (p *Parameter) UnmarshalText(text []byte) error {
+	var q Parameter
+	if err := q.parse(string(text), "mtpTS"); err != nil {
+		return fmt.Errorf("argon2id: %v", err)
+	}
+	*p = q
+	return nil
+}
+
+// parse parses comma-separated "name=value" pairs whose names are
+// exactly the bytes of names in order.
+func (p *Parameter) parse(s, names string) error {
+	pairs := strings.Split(s, ",")
+	if len(pairs) != len(names) {
+		return fmt.Errorf("invalid parameters %q", s)
+	}
+	for i, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name != names[i:i+1] {
+			return fmt.Errorf("invalid parameters %q", s)
+		}
+		bitSize := 32
+		if name == "p" {
+			bitSize = 8
+		}
+		n, err := strconv.ParseUint(value, 10, bitSize)
+		if err != nil {
+			return fmt.Errorf("invalid parameter %q: %v", pair, err)
+		}
+		switch name {
+		case "m":
+			p.Memory = uint32(n)
+		case "t":
+			p.Time = uint32(n)
+		case "p":
+			p.Parallelism = uint8(n)
+		case "T":
+			p.KeyLength = uint32(n)
+		case "S":
+			p.SaltLength = uint32(n)
+		}
+	}
+	return nil
+}
+
 // ParameterFirstRecommended returns a new Parameter
 // with [RFC 9106's the FIRST RECOMMENDED option].
 //
@@ -75,6 +139,52 @@ func ParameterSecondRecommended() Parameter {
 	}
 }
 
+// maxCalibrateTime caps Parameter.Time chosen by Calibrate.
+const maxCalibrateTime = 1024
+
+// Calibrate returns a Parameter with memory and parallelism whose Time is
+// increased, by benchmarking GenerateFromPassword on the current hardware,
+// until hashing takes at least targetDuration.
+// KeyLength and SaltLength are 32 and 16 as recommended by RFC 9106.
+// If targetDuration cannot be reached within 1024 passes, it returns
+// a Parameter with Time 1024 and an error.
+func Calibrate(targetDuration time.Duration, memory uint32, parallelism uint8) (Parameter, error) {
+	if targetDuration <= 0 {
+		return Parameter{}, fmt.Errorf("argon2id: non-positive target duration %v", targetDuration)
+	}
+	if parallelism == 0 || memory < 8*uint32(parallelism) {
+		return Parameter{}, fmt.Errorf("argon2id: invalid memory %d for parallelism %d", memory, parallelism)
+	}
+	param := Parameter{
+		Memory:      memory,
+		Time:        1,
+		Parallelism: parallelism,
+		KeyLength:   32,
+		SaltLength:  16,
+	}
+	for {
+		d := hashDuration(param)
+		if d >= targetDuration {
+			return param, nil
+		}
+		if param.Time >= maxCalibrateTime {
+			return param, fmt.Errorf("argon2id: %d passes took %v, less than %v", param.Time, d, targetDuration)
+		}
+		// Time is roughly proportional to the number of passes,
+		// so jump close to the target but at least by one pass.
+		next := uint64(param.Time) * uint64(targetDuration) / uint64(max(d, 1))
+		param.Time = uint32(min(max(next, uint64(param.Time)+1), maxCalibrateTime))
+	}
+}
+
+var hashDuration = measureHash
+
+func measureHash(param Parameter) time.Duration {
+	start := time.Now()
+	GenerateFromPassword(param, "password")
+	return time.Since(start)
+}
+
 var getRandomSalt = randomSalt
 
 func randomSalt(len uint32) []byte {
@@ -87,6 +197,34 @@ func randomSalt(len uint32) []byte {
 func GenerateFromPassword[Bytes ~string | ~[]byte](param Parameter, password Bytes) []byte {
 	salt := getRandomSalt(param.SaltLength)
 	key := argon2.IDKey([]byte(password), salt, param.Time, param.Memory, param.Parallelism, param.KeyLength)
+	return encode(param, salt, key)
+}
+
+// GenerateFromPasswordWithSecret is like GenerateFromPassword but keys the hash
+// with secret, a "pepper" stored separately from the hashes, as described in
+// RFC 9106 and NIST SP 800-63B. Since golang.org/x/crypto/argon2 does not
+// expose the secret input of Argon2, the password is replaced with
+// HMAC-SHA256(secret, password) before hashing.
+// Changing secret invalidates all hashes generated with it.
+// The hash must be compared with CompareHashAndPasswordWithSecret.
+func GenerateFromPasswordWithSecret[Bytes ~string | ~[]byte](param Parameter, password Bytes, secret []byte) []byte {
+	return GenerateFromPassword(param, pepper(password, secret))
+}
+
+// CompareHashAndPasswordWithSecret is like CompareHashAndPassword but for a hash
+// generated by GenerateFromPasswordWithSecret with the same secret.
+func CompareHashAndPasswordWithSecret[Bytes1, Bytes2 ~string | ~[]byte](hashedPassword Bytes1, password Bytes2, secret []byte) (Parameter, error) {
+	return CompareHashAndPassword(hashedPassword, pepper(password, secret))
+}
+
+func pepper[Bytes ~string | ~[]byte](password Bytes, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// encode returns the PHC string format of an argon2id hash.
+func encode(param Parameter, salt, key []byte) []byte {
 	return fmt.Appendf(nil, "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
 		argon2.Version, param.Memory, param.Time, param.Parallelism,
 		base64.RawStdEncoding.EncodeToString(salt),
@@ -96,47 +234,138 @@ func GenerateFromPassword[Bytes ~string | ~[]byte](param Parameter, password Byt
 // CompareHashAndPassword compares the PHC string format of an argon2id hashed password with its possible plaintext equivalent.
 // It returns parsed Parameter and nil on success, or the zero Parameter and an error on failure.
 // If a password and hash do not match, it returns the zero Parameter and ErrMismatchedHashAndPassword.
+// If hashedPassword is malformed, the error wraps ErrInvalidHash.
 func CompareHashAndPassword[Bytes1, Bytes2 ~string | ~[]byte](hashedPassword Bytes1, password Bytes2) (Parameter, error) {
-	fields := strings.Split(string(hashedPassword), "$")
+	cfg, salt, key, err := Parse(hashedPassword)
+	if err != nil {
+		return Parameter{}, err
+	}
+
+	otherKey := argon2.IDKey([]byte(password), salt, cfg.Time, cfg.Memory, cfg.Parallelism, cfg.KeyLength)
+
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return Parameter{}, ErrMismatchedHashAndPassword
+	}
+	return cfg, nil
+}
+
+// Parse parses the PHC string format of an argon2id hashed password and
+// returns its Parameter, salt and key without computing the hash,
+// which makes it much cheaper than CompareHashAndPassword when only
+// the parameters are needed.
+func Parse[Bytes ~string | ~[]byte](hashedPassword Bytes) (param Parameter, salt, key []byte, err error) {
+	return decode(string(hashedPassword))
+}
+
+// NeedsRehash reports whether hashedPassword was generated with parameters
+// other than param, in which case the password should be hashed again with param,
+// e.g. after the next successful login.
+func NeedsRehash[Bytes ~string | ~[]byte](hashedPassword Bytes, param Parameter) (bool, error) {
+	cfg, _, _, err := Parse(hashedPassword)
+	if err != nil {
+		return false, err
+	}
+	return cfg != param, nil
+}
+
+// Normalize parses the PHC string format of an argon2id hash and returns it
+// in the canonical format of GenerateFromPassword, without recomputing the hash.
+// Unlike CompareHashAndPassword, it accepts white space between fields
+// and padded base64, as written by some other tools.
+// Empty "keyid=" and "data=" parameters and "data=" field are dropped.
+// A hash with non-empty ones is rejected with ErrInvalidHash rather than
+// canonicalized, since the canonical format cannot represent them.
+func Normalize(hashedPassword []byte) ([]byte, error) {
+	s := strings.Join(strings.Fields(string(hashedPassword)), "")
+	fields := strings.Split(s, "$")
+	if n := len(fields); n == 6 || n == 7 {
+		fields[n-2] = strings.TrimRight(fields[n-2], "=")
+		fields[n-1] = strings.TrimRight(fields[n-1], "=")
+	}
+	cfg, salt, key, err := decode(strings.Join(fields, "$"))
+	if err != nil {
+		return nil, err
+	}
+	return encode(cfg, salt, key), nil
+}
+
+// decode parses the PHC string format of an argon2id hash.
+// It accepts optional "keyid=" and "data=" parameters after "m=,t=,p=",
+// as specified by the PHC string format, and an optional "data=" field
+// before the salt, as written by some other implementations, if they are empty.
+// Since golang.org/x/crypto/argon2 supports neither a secret key nor
+// associated data, a hash with non-empty ones is rejected with ErrInvalidHash.
+func decode(hashedPassword string) (cfg Parameter, salt, key []byte, err error) {
+	fields := strings.Split(hashedPassword, "$")
+	if len(fields) == 7 {
+		data, ok := strings.CutPrefix(fields[4], "data=")
+		if !ok {
+			return Parameter{}, nil, nil, fmt.Errorf("%w: invalid format %q", ErrInvalidHash, hashedPassword)
+		}
+		if data != "" {
+			return Parameter{}, nil, nil, unsupportedField(fields[4])
+		}
+		fields = slices.Delete(fields, 4, 5)
+	}
 	if len(fields) != 6 {
-		return Parameter{}, fmt.Errorf("argon2id: invalid format %q", hashedPassword)
+		return Parameter{}, nil, nil, fmt.Errorf("%w: invalid format %q", ErrInvalidHash, hashedPassword)
 	}
 
 	if fields[1] != "argon2id" {
-		return Parameter{}, fmt.Errorf("argon2id: variant mismatch %q", fields[1])
+		return Parameter{}, nil, nil, fmt.Errorf("%w: variant mismatch %q", ErrInvalidHash, fields[1])
 	}
 
 	var version int
-	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	_, err = fmt.Sscanf(fields[2], "v=%d", &version)
 	if err != nil {
-		return Parameter{}, fmt.Errorf("argon2id: %v", err)
+		return Parameter{}, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
 	}
 	if version != argon2.Version {
-		return Parameter{}, fmt.Errorf("argon2id: version mismatch %q", version)
+		return Parameter{}, nil, nil, fmt.Errorf("%w: version mismatch %d", ErrInvalidHash, version)
 	}
 
-	var cfg Parameter
-	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &cfg.Memory, &cfg.Time, &cfg.Parallelism)
+	params, err := cutOptionalParams(fields[3])
 	if err != nil {
-		return Parameter{}, fmt.Errorf("argon2id: %v", err)
+		return Parameter{}, nil, nil, err
+	}
+	if err := cfg.parse(params, "mtp"); err != nil {
+		return Parameter{}, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
 	}
 
-	salt, err := base64.RawStdEncoding.Strict().DecodeString(fields[4])
+	salt, err = base64.RawStdEncoding.Strict().DecodeString(fields[4])
 	if err != nil {
-		return Parameter{}, fmt.Errorf("argon2id: %v", err)
+		return Parameter{}, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
 	}
 	cfg.SaltLength = uint32(len(salt))
 
-	key, err := base64.RawStdEncoding.Strict().DecodeString(fields[5])
+	key, err = base64.RawStdEncoding.Strict().DecodeString(fields[5])
 	if err != nil {
-		return Parameter{}, fmt.Errorf("argon2id: %v", err)
+		return Parameter{}, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
 	}
 	cfg.KeyLength = uint32(len(key))
+	return cfg, salt, key, nil
+}
 
-	otherKey := argon2.IDKey([]byte(password), salt, cfg.Time, cfg.Memory, cfg.Parallelism, cfg.KeyLength)
-
-	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
-		return Parameter{}, ErrMismatchedHashAndPassword
+// cutOptionalParams returns params without the optional "keyid" and "data"
+// parameters that follow "m=,t=,p=" in this order.
+// It returns an error if either of them is not empty.
+func cutOptionalParams(params string) (string, error) {
+	for _, name := range []string{",data=", ",keyid="} {
+		i := strings.LastIndex(params, name)
+		if i < 0 {
+			continue
+		}
+		if value := params[i+len(name):]; value != "" {
+			return "", unsupportedField(params[i+1:])
+		}
+		params = params[:i]
 	}
-	return cfg, nil
+	return params, nil
+}
+
+// unsupportedField returns an error for a non-empty keyid or data field.
+// The hash cannot be verified without them, and reporting a mismatch would
+// look like a wrong password.
+func unsupportedField(field string) error {
+	return fmt.Errorf("%w: unsupported field %q: golang.org/x/crypto/argon2 supports neither a secret key nor associated data", ErrInvalidHash, field)
 }
@@ -2,12 +2,18 @@ package argon2id
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"math"
 	"os/exec"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
 )
 
 func testConfigs() []Parameter {
@@ -128,3 +134,310 @@ func TestWithArgon2(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalize(t *testing.T) {
+	defer func() { getRandomSalt = randomSalt }()
+	getRandomSalt = func(_ uint32) []byte { return []byte("somesalt") }
+	param := Parameter{Memory: 1024, Time: 1, Parallelism: 1, KeyLength: 16, SaltLength: 8}
+	want := GenerateFromPassword(param, "hunter2")
+
+	// salt "somesalt" is c29tZXNhbHQ in unpadded base64.
+	padded := bytes.Replace(want, []byte("c29tZXNhbHQ$"), []byte("c29tZXNhbHQ=$"), 1)
+	padded = append(padded, "=="...)
+	spaced := bytes.ReplaceAll(want, []byte(","), []byte(", "))
+	spaced = append(append([]byte(" "), spaced...), '\n')
+
+	for _, hash := range [][]byte{want, padded, spaced} {
+		got, err := Normalize(hash)
+		if err != nil {
+			t.Fatalf("Normalize(%q): %v", hash, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Normalize(%q) = %q; want %q", hash, got, want)
+		}
+		if _, err := CompareHashAndPassword(got, "hunter2"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, hash := range []string{"", "$argon2i$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$AAAA", "$argon2id$v=19$m=1024$c29tZXNhbHQ$AAAA"} {
+		if _, err := Normalize([]byte(hash)); err == nil {
+			t.Errorf("Normalize(%q): expected error", hash)
+		}
+	}
+
+	// Empty keyid and data are dropped; non-empty ones cannot be represented.
+	withEmpty := strings.Replace(referenceHash, "p=1$", "p=1,keyid=,data=$", 1)
+	if got, err := Normalize([]byte(withEmpty)); err != nil || string(got) != referenceHash {
+		t.Errorf("Normalize(%q) = %q, %v; want %q", withEmpty, got, err, referenceHash)
+	}
+	withKeyID := strings.Replace(referenceHash, "p=1$", "p=1,keyid=AwMDAwMDAwM$", 1)
+	for _, hash := range []string{referenceHashWithData, withKeyID} {
+		if got, err := Normalize([]byte(hash)); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("Normalize(%q) = %q, %v; want %v", hash, got, err, ErrInvalidHash)
+		}
+	}
+}
+
+func TestErrInvalidHash(t *testing.T) {
+	param := Parameter{Memory: 1024, Time: 1, Parallelism: 1, KeyLength: 16, SaltLength: 8}
+	hash := string(GenerateFromPassword(param, "hunter2"))
+	if _, err := CompareHashAndPassword(hash, "hunter3"); !errors.Is(err, ErrMismatchedHashAndPassword) || errors.Is(err, ErrInvalidHash) {
+		t.Errorf("got %v; want %v", err, ErrMismatchedHashAndPassword)
+	}
+
+	for _, hash := range []string{
+		"",
+		strings.Replace(hash, "argon2id", "argon2i", 1),
+		strings.Replace(hash, "v=19", "v=16", 1),
+		strings.Replace(hash, "v=19", "v=x", 1),
+		strings.Replace(hash, ",p=1", "", 1),
+		hash[:len(hash)-1] + "!",
+		strings.Replace(hash, "$", "$!", 4),
+	} {
+		if _, err := CompareHashAndPassword(hash, "hunter2"); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("CompareHashAndPassword(%q) = %v; want %v", hash, err, ErrInvalidHash)
+		}
+	}
+}
+
+// Test vectors of the reference implementation (phc-winner-argon2).
+const (
+	// echo -n password | argon2 somesalt -id -t 2 -m 16 -p 1 -l 32 -e
+	referenceHash = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	// RFC 9106 Section 5.3, with password 32 bytes of 0x01, secret 8 bytes
+	// of 0x03 and associated data 12 bytes of 0x04.
+	referenceHashWithData = "$argon2id$v=19$m=32,t=3,p=4,data=BAQEBAQEBAQEBAQE$AgICAgICAgICAgICAgICAg$DWQN9Y14dmwIwDejSotTydAe8EUtdbZetSUg6WsB5lk"
+)
+
+func TestDataField(t *testing.T) {
+	want := Parameter{Memory: 65536, Time: 2, Parallelism: 1, KeyLength: 32, SaltLength: 8}
+	i := strings.LastIndex(referenceHash, "$")
+	i = strings.LastIndex(referenceHash[:i], "$")
+	// An empty data field does not change the hash.
+	withData := referenceHash[:i] + "$data=" + referenceHash[i:]
+
+	for _, h := range []string{referenceHash, withData} {
+		got, err := CompareHashAndPassword(h, "password")
+		if err != nil {
+			t.Fatalf("CompareHashAndPassword(%q): %v", h, err)
+		}
+		if got != want {
+			t.Errorf("got %+v; want %+v", got, want)
+		}
+		if _, err := CompareHashAndPassword(h, "hunter3"); err != ErrMismatchedHashAndPassword {
+			t.Errorf("got %v; want %v", err, ErrMismatchedHashAndPassword)
+		}
+	}
+
+	for _, h := range []string{
+		referenceHash[:i] + "$data=c29tZWRhdGE" + referenceHash[i:],
+		referenceHash[:i] + "$keyid=" + referenceHash[i:],
+		referenceHash[:i] + "$data=!" + referenceHash[i:],
+		referenceHash[:i] + "$data=$data=" + referenceHash[i:],
+	} {
+		if _, err := CompareHashAndPassword(h, "password"); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("CompareHashAndPassword(%q) = %v; want %v", h, err, ErrInvalidHash)
+		}
+	}
+}
+
+func TestOptionalParams(t *testing.T) {
+	want := Parameter{Memory: 65536, Time: 2, Parallelism: 1, KeyLength: 32, SaltLength: 8}
+	params := "m=65536,t=2,p=1"
+	// Empty keyid and data parameters do not change the hash.
+	for _, extra := range []string{"", ",data=", ",keyid=", ",keyid=,data="} {
+		h := strings.Replace(referenceHash, params, params+extra, 1)
+		got, err := CompareHashAndPassword(h, "password")
+		if err != nil {
+			t.Fatalf("CompareHashAndPassword(%q): %v", h, err)
+		}
+		if got != want {
+			t.Errorf("got %+v; want %+v", got, want)
+		}
+	}
+
+	// A hash computed with associated data or a secret key cannot be
+	// verified, which must not be reported as a wrong password.
+	password := bytes.Repeat([]byte{0x01}, 32)
+	if _, err := CompareHashAndPassword(referenceHashWithData, password); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("CompareHashAndPassword(%q) = %v; want %v", referenceHashWithData, err, ErrInvalidHash)
+	}
+	for _, extra := range []string{
+		",keyid=AwMDAwMDAwM",
+		",data=BAQEBAQEBAQEBAQE,keyid=",
+		",data=,data=",
+		",x=1",
+	} {
+		h := strings.Replace(referenceHash, params, params+extra, 1)
+		if _, err := CompareHashAndPassword(h, "password"); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("CompareHashAndPassword(%q) = %v; want %v", h, err, ErrInvalidHash)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	defer func() { getRandomSalt = randomSalt }()
+	getRandomSalt = func(_ uint32) []byte { return []byte("somesalt") }
+	param := Parameter{Memory: 1024, Time: 2, Parallelism: 1, KeyLength: 16, SaltLength: 8}
+	hash := GenerateFromPassword(param, "hunter2")
+
+	got, salt, key, err := Parse(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != param {
+		t.Errorf("got %+v; want %+v", got, param)
+	}
+	if string(salt) != "somesalt" {
+		t.Errorf("got salt %q; want %q", salt, "somesalt")
+	}
+	if want := argon2.IDKey([]byte("hunter2"), salt, param.Time, param.Memory, param.Parallelism, param.KeyLength); !bytes.Equal(key, want) {
+		t.Errorf("got key %x; want %x", key, want)
+	}
+
+	if _, _, _, err := Parse("$argon2id$v=19$m=1024$c29tZXNhbHQ$AAAA"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestParameterText(t *testing.T) {
+	param := ParameterSecondRecommended()
+	text, err := param.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(text), "m=65536,t=3,p=4,T=32,S=16"; got != want {
+		t.Errorf("MarshalText() = %q; want %q", got, want)
+	}
+
+	b, err := json.Marshal(map[string]Parameter{"argon2id": param})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]Parameter
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["argon2id"] != param {
+		t.Errorf("got %+v; want %+v", got["argon2id"], param)
+	}
+
+	for _, text := range []string{"", "m=65536,t=3,p=4", "m=65536,t=3,p=4,T=32,S=16,x=1", "t=3,m=65536,p=4,T=32,S=16", "m=65536,t=3,p=256,T=32,S=16", "m=-1,t=3,p=4,T=32,S=16"} {
+		var p Parameter
+		if err := p.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("UnmarshalText(%q): expected error", text)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	param := Parameter{Memory: 1024, Time: 1, Parallelism: 1, KeyLength: 16, SaltLength: 8}
+	hash := GenerateFromPassword(param, "hunter2")
+
+	tests := []struct {
+		modify func(*Parameter)
+		want   bool
+	}{
+		{func(*Parameter) {}, false},
+		{func(p *Parameter) { p.Memory = 2048 }, true},
+		{func(p *Parameter) { p.Time = 2 }, true},
+		{func(p *Parameter) { p.Parallelism = 2 }, true},
+		{func(p *Parameter) { p.KeyLength = 32 }, true},
+		{func(p *Parameter) { p.SaltLength = 16 }, true},
+	}
+	for _, tt := range tests {
+		target := param
+		tt.modify(&target)
+		got, err := NeedsRehash(hash, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("NeedsRehash(%s, %+v) = %v; want %v", hash, target, got, tt.want)
+		}
+	}
+
+	if _, err := NeedsRehash("invalid", param); err == nil {
+		t.Error("expected error for an invalid hash")
+	}
+}
+
+func TestSecret(t *testing.T) {
+	param := Parameter{Memory: 1024, Time: 1, Parallelism: 1, KeyLength: 16, SaltLength: 8}
+	secret := []byte("pepper")
+	hash := GenerateFromPasswordWithSecret(param, "hunter2", secret)
+
+	got, err := CompareHashAndPasswordWithSecret(hash, "hunter2", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != param {
+		t.Fatalf("\ngot\n\t%+v\nwant\n\t%+v", got, param)
+	}
+
+	tests := []struct {
+		password string
+		secret   []byte
+	}{
+		{"hunter3", secret},
+		{"hunter2", []byte("other")},
+		{"hunter2", nil},
+	}
+	for _, tt := range tests {
+		if _, err := CompareHashAndPasswordWithSecret(hash, tt.password, tt.secret); err != ErrMismatchedHashAndPassword {
+			t.Errorf("(%q, %q): got %v; want %v", tt.password, tt.secret, err, ErrMismatchedHashAndPassword)
+		}
+	}
+	if _, err := CompareHashAndPassword(hash, "hunter2"); err != ErrMismatchedHashAndPassword {
+		t.Errorf("got %v; want %v without secret", err, ErrMismatchedHashAndPassword)
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	defer func() { hashDuration = measureHash }()
+	// each pass takes 10ms
+	hashDuration = func(param Parameter) time.Duration {
+		return time.Duration(param.Time) * 10 * time.Millisecond
+	}
+
+	tests := []struct {
+		target   time.Duration
+		wantTime uint32
+		wantErr  bool
+	}{
+		{time.Millisecond, 1, false},
+		{10 * time.Millisecond, 1, false},
+		{11 * time.Millisecond, 2, false},
+		{250 * time.Millisecond, 25, false},
+		{time.Hour, maxCalibrateTime, true},
+		{0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Calibrate(tt.target, 64*1024, 4)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Calibrate(%v) error = %v; want error %v", tt.target, err, tt.wantErr)
+		}
+		if got.Time != tt.wantTime {
+			t.Errorf("Calibrate(%v).Time = %v; want %v", tt.target, got.Time, tt.wantTime)
+		}
+		if !tt.wantErr && (got.Memory != 64*1024 || got.Parallelism != 4) {
+			t.Errorf("Calibrate(%v) = %+v", tt.target, got)
+		}
+	}
+
+	if _, err := Calibrate(time.Millisecond, 16, 4); err == nil {
+		t.Error("expected error for too little memory")
+	}
+}
+
+func TestCalibrateHardware(t *testing.T) {
+	target := 5 * time.Millisecond
+	param, err := Calibrate(target, 1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if param.Time < 1 {
+		t.Errorf("got %+v", param)
+	}
+}
@@ -5,21 +5,204 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
 const configFlagName = "config"
 
+// repeatableFlag is implemented by a [flag.Value] whose Set accumulates values,
+// so that the flag can be specified multiple times.
+// A value is repeatable if it has an IsRepeatable method that returns true.
+type repeatableFlag interface {
+	flag.Value
+	IsRepeatable() bool
+}
+
+func isRepeatable(f *flag.Flag) bool {
+	r, ok := f.Value.(repeatableFlag)
+	return ok && r.IsRepeatable()
+}
+
+// Parse parses flags in fs from a config file, environment variables and args,
+// in ascending order of precedence.
+//
+// The environment variable of a flag is envPrefix followed by the flag name
+// in upper case with "-" and "." replaced by "_", e.g. PREFIX_ACCESS_KEY for -access-key.
+// For a repeatable flag (see repeatableFlag), indexed environment variables
+// NAME_0, NAME_1, ... are also read in index order until one is missing,
+// and each of them sets the flag once after NAME.
+// A repeatable flag may also appear more than once in a config file.
 func Parse(fs *flag.FlagSet, args []string, envPrefix string) error {
+	p := Parser{EnvPrefix: envPrefix}
+	return p.Parse(fs, args)
+}
+
+// ParseWithSources is like [Parse] but also reports where the value of each
+// flag in fs came from, as described in [Parser.ParseWithSources].
+// configFlagName is the name of the flag that specifies the config file;
+// if empty, "config" is used.
+func ParseWithSources(fs *flag.FlagSet, args []string, configFlagName, envPrefix string) (map[string]Source, error) {
+	p := Parser{EnvPrefix: envPrefix, ConfigFlagName: configFlagName}
+	return p.ParseWithSources(fs, args)
+}
+
+// Source is where the value of a flag came from.
+type Source int
+
+const (
+	SourceDefault Source = iota // the flag was not set
+	SourceFlag                  // command line arguments
+	SourceEnv                   // an environment variable
+	SourceFile                  // the config file, in either form
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceDefault:
+		return "default"
+	case SourceFlag:
+		return "flag"
+	case SourceEnv:
+		return "env"
+	case SourceFile:
+		return "file"
+	}
+	return "Source(" + strconv.Itoa(int(s)) + ")"
+}
+
+// sources returns the source of each flag in fs after fs.Parse(args)
+// succeeded, where the first len(fromFile) arguments came from fromFile.
+// It replays args on a copy of fs whose values only record the order of
+// Set calls: each argument before args from the command line sets a flag
+// exactly once, and the last Set of a flag determines its value.
+func sources(fs *flag.FlagSet, args []string, fromFile []Source) map[string]Source {
+	m := make(map[string]Source)
+	replay := flag.NewFlagSet("", flag.ContinueOnError)
+	replay.SetOutput(io.Discard)
+	n := 0
+	fs.VisitAll(func(f *flag.Flag) {
+		m[f.Name] = SourceDefault
+		replay.Var(&sourceRecorder{isBool: isBoolFlag(f), set: func() {
+			if n < len(fromFile) {
+				m[f.Name] = fromFile[n]
+			} else {
+				m[f.Name] = SourceFlag
+			}
+			n++
+		}}, f.Name, "")
+	})
+	_ = replay.Parse(args)
+	return m
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// sourceRecorder is a flag.Value that calls set instead of storing a value.
+type sourceRecorder struct {
+	isBool bool
+	set    func()
+}
+
+func (r *sourceRecorder) String() string   { return "" }
+func (r *sourceRecorder) Set(string) error { r.set(); return nil }
+func (r *sourceRecorder) IsBoolFlag() bool { return r.isBool }
+
+// Parser parses flags like [Parse] with more options.
+// The zero value is a Parser with an empty environment variable prefix.
+type Parser struct {
+	// EnvPrefix is the prefix of environment variables.
+	EnvPrefix string
+	// ConfigFlagName is the name of the flag that specifies the config file.
+	// The default is "config".
+	ConfigFlagName string
+	// ConfigEnvName is the name of the environment variable that specifies
+	// the config file, e.g. "APP_CONFIG_PATH". It is used as is, without EnvPrefix.
+	// The default is derived from ConfigFlagName like other flags,
+	// e.g. PREFIX_CONFIG.
+	ConfigEnvName string
+	// CaseInsensitive makes environment variable names, including those in
+	// the config file, match regardless of case, e.g. both access_key and
+	// ACCESS_KEY set -access-key. It is an error if a name to be looked up
+	// matches more than one variable that differ only in case.
+	CaseInsensitive bool
+	// StrictEnv makes Parse fail if an environment variable that starts with
+	// EnvPrefix does not correspond to a flag, e.g. a misspelled APP_ADDRES,
+	// which would otherwise be ignored silently. EnvPrefix must not be empty,
+	// since every environment variable would be checked otherwise.
+	StrictEnv bool
+	// DefaultConfigPaths are tried in order when neither the config flag
+	// nor its environment variable specifies a config file, and the first
+	// one that exists is loaded. Missing files are skipped silently.
+	// Paths are used as is; build them with e.g. [os.UserConfigDir].
+	DefaultConfigPaths []string
+}
+
+func (p *Parser) configFlagName() string {
+	return cmp.Or(p.ConfigFlagName, configFlagName)
+}
+
+func (p *Parser) configEnvName() string {
+	return cmp.Or(p.ConfigEnvName, p.EnvPrefix+flagNameToEnvName(p.configFlagName()))
+}
+
+// Parse parses flags in fs from a config file, environment variables and args
+// as described in [Parse].
+func (p *Parser) Parse(fs *flag.FlagSet, args []string) error {
+	_, _, err := p.parse(fs, args)
+	return err
+}
+
+// ParseWithSources is like Parse but also reports where the value of each
+// flag in fs came from, keyed by flag name. Flags that were not set are
+// reported as SourceDefault. A flag set more than once, e.g. both in the
+// config file and in args, is reported with the source that took precedence.
+func (p *Parser) ParseWithSources(fs *flag.FlagSet, args []string) (map[string]Source, error) {
+	args, fromFile, err := p.parse(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	return sources(fs, args, fromFile), nil
+}
+
+// parse parses flags in fs and returns the arguments it passed to fs.Parse,
+// in which the first len(sources) arguments are "-name=value" from a config
+// file or environment variables and sources holds where each of them came from.
+func (p *Parser) parse(fs *flag.FlagSet, args []string) (_ []string, _ []Source, err error) {
+	envPrefix := p.EnvPrefix
+	configFlagName := p.configFlagName()
 	var (
 		flagsFromFile   []string
+		fromFile        []Source
 		envVarsFromFile map[string]string
 		envVarsFromEnv  map[string]bool
-		err             error
 	)
 
-	configPath := os.Getenv(envPrefix + flagNameToEnvName(configFlagName))
+	if p.StrictEnv {
+		if envPrefix == "" {
+			return nil, nil, errors.New("flagenv: StrictEnv requires EnvPrefix")
+		}
+		if err := p.checkUnknownEnv(fs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	getenv := func(name string) (string, error) { return os.Getenv(name), nil }
+	if p.CaseInsensitive {
+		getenv = foldedLookup(environ())
+	}
+	configPath, err := getenv(p.configEnvName())
+	if err != nil {
+		return nil, nil, err
+	}
 	if len(args) > 0 {
 		if arg, ok := strings.CutPrefix(args[0], "-"); ok {
 			arg, _ = strings.CutPrefix(arg, "-")
@@ -27,7 +210,7 @@ func Parse(fs *flag.FlagSet, args []string, envPrefix string) error {
 			if flagName == configFlagName {
 				args = args[1:]
 				if !ok && len(args) == 0 {
-					return fmt.Errorf("flagenv: missing arguments to -%s", configFlagName)
+					return nil, nil, fmt.Errorf("flagenv: missing arguments to -%s", configFlagName)
 				}
 				fileName := value
 				if !ok {
@@ -39,11 +222,38 @@ func Parse(fs *flag.FlagSet, args []string, envPrefix string) error {
 			}
 		}
 	}
+	if configPath == "" {
+		if configPath, err = findConfigFile(p.DefaultConfigPaths); err != nil {
+			return nil, nil, fmt.Errorf("flagenv: failed to find config file: %v", err)
+		}
+	}
 	if configPath != "" {
-		flagsFromFile, envVarsFromFile, err = loadConfigFile(configPath)
+		flagsFromFile, envVarsFromFile, err = loadConfigFile(configPath, fs)
 		if err != nil {
-			return fmt.Errorf("flagenv: failed to load config file: %v", err)
+			return nil, nil, fmt.Errorf("flagenv: failed to load config file: %v", err)
 		}
+		fromFile = slices.Repeat([]Source{SourceFile}, len(flagsFromFile))
+	}
+	getFileEnv := func(name string) (string, error) { return envVarsFromFile[name], nil }
+	if p.CaseInsensitive && envVarsFromFile != nil {
+		getFileEnv = foldedLookup(envVarsFromFile)
+		folded := make(map[string]string, len(envVarsFromFile))
+		for name, value := range envVarsFromFile {
+			folded[strings.ToUpper(name)] = value
+		}
+		envVarsFromFile = folded
+	}
+	lookup := func(name string) (string, Source, error) {
+		env, err := getenv(name)
+		if env != "" || err != nil {
+			return env, SourceEnv, err
+		}
+		env, err = getFileEnv(name)
+		return env, SourceFile, err
+	}
+	key := func(name string) string { return name }
+	if p.CaseInsensitive {
+		key = strings.ToUpper
 	}
 
 	detectUndefinedEnvVars := envVarsFromFile != nil
@@ -55,14 +265,41 @@ func Parse(fs *flag.FlagSet, args []string, envPrefix string) error {
 	}
 
 	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
 		name := envPrefix + flagNameToEnvName(f.Name)
 		if detectUndefinedEnvVars {
-			envVarsFromEnv[name] = false
+			envVarsFromEnv[key(name)] = false
+		}
+		var env string
+		var source Source
+		if env, source, err = lookup(name); err != nil {
+			return
+		} else if env != "" {
+			flagsFromFile = append(flagsFromFile, fmt.Sprintf("-%s=%s", f.Name, env))
+			fromFile = append(fromFile, source)
+		}
+		if !isRepeatable(f) {
+			return
 		}
-		if env := cmp.Or(os.Getenv(name), envVarsFromFile[name]); env != "" {
+		for i := 0; ; i++ {
+			name := fmt.Sprintf("%s_%d", name, i)
+			if env, source, err = lookup(name); err != nil {
+				return
+			} else if env == "" {
+				break
+			}
+			if detectUndefinedEnvVars {
+				envVarsFromEnv[key(name)] = false
+			}
 			flagsFromFile = append(flagsFromFile, fmt.Sprintf("-%s=%s", f.Name, env))
+			fromFile = append(fromFile, source)
 		}
 	})
+	if err != nil {
+		return nil, nil, err
+	}
 
 	if detectUndefinedEnvVars {
 		var undefined []string
@@ -72,63 +309,383 @@ func Parse(fs *flag.FlagSet, args []string, envPrefix string) error {
 			}
 		}
 		if len(undefined) > 0 {
-			return fmt.Errorf("flagenv: undefined env vars: %v", undefined)
+			return nil, nil, fmt.Errorf("flagenv: undefined env vars: %v", undefined)
 		}
 	}
 
 	args = append(flagsFromFile, args...)
-	return fs.Parse(args)
+	return args, fromFile, fs.Parse(args)
 }
 
-func loadConfigFile(fileName string) (flags []string, envVars map[string]string, err error) {
-	envVars = make(map[string]string)
-	envNames := make(map[string]struct{})
-	b, err := os.ReadFile(fileName)
+// checkUnknownEnv returns an error if an environment variable that starts
+// with EnvPrefix is neither the config file variable nor that of a flag in fs.
+func (p *Parser) checkUnknownEnv(fs *flag.FlagSet) error {
+	key := func(name string) string { return name }
+	if p.CaseInsensitive {
+		key = strings.ToUpper
+	}
+	known := map[string]bool{key(p.configEnvName()): true}
+	repeatable := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) {
+		name := key(p.EnvPrefix + flagNameToEnvName(f.Name))
+		known[name] = true
+		if isRepeatable(f) {
+			repeatable[name] = true
+		}
+	})
+	var unknown []string
+	for name := range environ() {
+		k := key(name)
+		if !strings.HasPrefix(k, key(p.EnvPrefix)) || known[k] {
+			continue
+		}
+		if i := strings.LastIndexByte(k, '_'); i >= 0 && repeatable[k[:i]] {
+			if _, err := strconv.ParseUint(k[i+1:], 10, 0); err == nil {
+				continue
+			}
+		}
+		unknown = append(unknown, name)
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("flagenv: unknown env vars: %v", unknown)
+	}
+	return nil
+}
+
+// findConfigFile returns the first of paths that exists, or "" if none does.
+func findConfigFile(paths []string) (string, error) {
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// ParseArgs is like [Parse] but also returns the positional arguments
+// left after parsing, i.e. fs.Args().
+//
+// Positional arguments come only from args: flags from a config file
+// and environment variables are placed before args, so they never end
+// flag parsing or become positional. In args, parsing stops just before
+// the first non-flag argument or just after the terminator "--",
+// and the remaining arguments are positional, even if they look like flags.
+// Only the first "--" is consumed; a later one is a positional argument.
+// The -config flag is recognized only as the first argument.
+func ParseArgs(fs *flag.FlagSet, args []string, envPrefix string) ([]string, error) {
+	if err := Parse(fs, args, envPrefix); err != nil {
+		return nil, err
+	}
+	return fs.Args(), nil
+}
+
+// Dump writes the current values of all flags in fs to w in the config file format.
+// Each flag is preceded by its usage and default value as comments and
+// separated by a blank line, so that the output can be edited and loaded
+// as a config file. A repeatable flag is written once per value, so its value
+// must implement [flag.Getter] returning []string; otherwise Dump returns an
+// error without writing anything.
+// Values are quoted and escaped as needed to be loaded as is:
+// "$" is doubled, and a value with white space, "#" or a double quote is
+// enclosed in double quotes with backslash escapes for \", \\, \n, \r and \t.
+func Dump(fs *flag.FlagSet, w io.Writer) error {
+	var b strings.Builder
+	var err error
+	first := true
+	fs.VisitAll(func(f *flag.Flag) {
+		values := []string{f.Value.String()}
+		if isRepeatable(f) {
+			var ok bool
+			if values, ok = repeatedValues(f); !ok && err == nil {
+				err = fmt.Errorf("flagenv: cannot dump repeatable flag -%s: its value does not implement flag.Getter returning []string", f.Name)
+			}
+		}
+		if !first {
+			b.WriteString("\n")
+		}
+		first = false
+		for line := range strings.Lines(f.Usage) {
+			fmt.Fprintf(&b, "# %s\n", strings.TrimRight(line, "\n"))
+		}
+		fmt.Fprintf(&b, "# default: %s\n", f.DefValue)
+		for _, v := range values {
+			fmt.Fprintf(&b, "-%s=%s\n", f.Name, quote(v))
+		}
+	})
 	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// repeatedValues returns the values of a repeatable flag f
+// if its value implements [flag.Getter] returning []string.
+func repeatedValues(f *flag.Flag) ([]string, bool) {
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return nil, false
+	}
+	values, ok := g.Get().([]string)
+	return values, ok
+}
+
+// quote returns value in the form that loadConfigFile reads back as value.
+func quote(value string) string {
+	value = strings.ReplaceAll(value, "$", "$$")
+	if !strings.ContainsFunc(value, unicode.IsSpace) && !strings.ContainsAny(value, `#"`) {
+		return value
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range value {
+		switch c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// maxIncludeDepth is the maximum nesting depth of @include directives.
+const maxIncludeDepth = 8
+
+// loadConfigFile loads a config file for fs.
+// A flag of fs that is repeatable may appear more than once in the -name form,
+// and each occurrence sets it in order.
+//
+// A line "@include path" loads another config file in its place, where path
+// is relative to the directory of the including file. Entries after the
+// directive override those of the included file, so a base config can be
+// layered with overrides. Include cycles are rejected.
+func loadConfigFile(fileName string, fs *flag.FlagSet) (flags []string, envVars map[string]string, err error) {
+	l := configLoader{fs: fs, envVars: make(map[string]string), including: make(map[string]bool)}
+	if err := l.load(fileName, 0); err != nil {
 		return nil, nil, err
 	}
+	return l.flags, l.envVars, nil
+}
+
+type configLoader struct {
+	fs        *flag.FlagSet
+	flags     []string
+	envVars   map[string]string
+	including map[string]bool // absolute paths of the files being loaded
+}
+
+func (l *configLoader) load(fileName string, depth int) error {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	l.including[path] = true
+	defer delete(l.including, path)
+
+	envNames := make(map[string]struct{})
 	lineNumber := 0
 	for line := range strings.Lines(string(b)) {
 		lineNumber++
-		line, _, _ = strings.Cut(line, "#")
-		line = strings.TrimSpace(line)
+		line = strings.TrimSpace(cutComment(line))
 		if line == "" {
 			continue
 		}
-		if flag := strings.HasPrefix(line, "-"); flag {
-			flagName, _, ok := strings.Cut(line[len("-"):], "=")
-			envName := flagNameToEnvName(flagName)
-			if _, dup := envNames[envName]; dup {
-				return nil, nil, dupError(fileName, lineNumber, flagName)
+		if rest, ok := strings.CutPrefix(line, "@include"); ok && (rest == "" || unicode.IsSpace(rune(rest[0]))) {
+			include, _, err := unquote(rest)
+			if err != nil {
+				return syntaxError(fileName, lineNumber, err.Error())
 			}
-			envNames[envName] = struct{}{}
-			if ok {
-				// -name=value
-				flags = append(flags, line)
-			} else {
-				// -name value
-				fields := strings.Fields(line)
-				if len(fields) != 2 {
-					return nil, nil, syntaxError(fileName, lineNumber, "found extra characters")
+			if include == "" {
+				return syntaxError(fileName, lineNumber, "missing path to include")
+			}
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(fileName), include)
+			}
+			if abs, err := filepath.Abs(include); err == nil && l.including[abs] {
+				return syntaxError(fileName, lineNumber, fmt.Sprintf("include cycle: %s", include))
+			}
+			if depth+1 > maxIncludeDepth {
+				return syntaxError(fileName, lineNumber, fmt.Sprintf("includes nested deeper than %d", maxIncludeDepth))
+			}
+			if err := l.load(include, depth+1); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return syntaxError(fileName, lineNumber, err.Error())
 				}
-				flags = append(flags, fields...)
+				return err
 			}
-		} else {
-			if fields := strings.Fields(line); len(fields) != 1 {
-				return nil, nil, syntaxError(fileName, lineNumber, "found space characters")
+			continue
+		}
+		if flag := strings.HasPrefix(line, "-"); flag {
+			i := strings.IndexAny(line, "= \t")
+			if i < 0 {
+				return syntaxError(fileName, lineNumber, "missing value")
 			}
-			if envName, value, ok := strings.Cut(line, "="); !ok {
-				return nil, nil, errors.New("missing =")
-			} else {
+			flagName := line[len("-"):i]
+			if f := l.fs.Lookup(flagName); f == nil || !isRepeatable(f) {
+				envName := flagNameToEnvName(flagName)
 				if _, dup := envNames[envName]; dup {
-					return nil, nil, dupError(fileName, lineNumber, envName)
+					return dupError(fileName, lineNumber, flagName)
 				}
 				envNames[envName] = struct{}{}
-				envVars[envName] = value
 			}
+			value, quoted, err := unquote(line[i+1:])
+			if err != nil {
+				return syntaxError(fileName, lineNumber, err.Error())
+			}
+			// -name value
+			if line[i] != '=' && !quoted && (value == "" || strings.ContainsFunc(value, unicode.IsSpace)) {
+				return syntaxError(fileName, lineNumber, "found extra characters")
+			}
+			l.flags = append(l.flags, "-"+flagName+"="+expandEnv(value))
+		} else {
+			envName, value, ok := strings.Cut(line, "=")
+			if strings.ContainsFunc(envName, unicode.IsSpace) {
+				return syntaxError(fileName, lineNumber, "found space characters")
+			}
+			if !ok {
+				return errors.New("missing =")
+			}
+			value, quoted, err := unquote(value)
+			if err != nil {
+				return syntaxError(fileName, lineNumber, err.Error())
+			}
+			if !quoted && strings.ContainsFunc(value, unicode.IsSpace) {
+				return syntaxError(fileName, lineNumber, "found space characters")
+			}
+			if _, dup := envNames[envName]; dup {
+				return dupError(fileName, lineNumber, envName)
+			}
+			envNames[envName] = struct{}{}
+			l.envVars[envName] = expandEnv(value)
+		}
+	}
+	return nil
+}
+
+// environ returns the environment variables as a map.
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			env[name] = value
 		}
 	}
-	return flags, envVars, nil
+	return env
+}
+
+// foldedLookup returns a function that looks up env case-insensitively.
+// The function returns an error if the name matches more than one variable.
+func foldedLookup(env map[string]string) func(string) (string, error) {
+	names := make(map[string][]string)
+	for name := range env {
+		folded := strings.ToUpper(name)
+		names[folded] = append(names[folded], name)
+	}
+	return func(name string) (string, error) {
+		switch matches := names[strings.ToUpper(name)]; len(matches) {
+		case 0:
+			return "", nil
+		case 1:
+			return env[matches[0]], nil
+		default:
+			slices.Sort(matches)
+			return "", fmt.Errorf("flagenv: ambiguous env vars: %v", matches)
+		}
+	}
+}
+
+// cutComment returns line without a comment that starts with "#"
+// outside double quotes.
+func cutComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++ // skip the escaped character
+			}
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// unquote returns value with surrounding white space removed.
+// If value starts with a double quote, it returns the characters up to
+// the closing double quote, and reports that value was quoted.
+// In a quoted value, \", \\, \n, \r and \t are escape sequences,
+// and a backslash followed by another character stands for itself.
+func unquote(value string) (string, bool, error) {
+	value = strings.TrimSpace(value)
+	rest, ok := strings.CutPrefix(value, `"`)
+	if !ok {
+		return value, false, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(rest); i++ {
+		switch c := rest[i]; c {
+		case '"':
+			if rest[i+1:] != "" {
+				return "", false, errors.New("found extra characters")
+			}
+			return b.String(), true, nil
+		case '\\':
+			if i+1 == len(rest) {
+				break
+			}
+			switch next := rest[i+1]; next {
+			case '"', '\\':
+				b.WriteByte(next)
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(c)
+				continue
+			}
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false, errors.New("missing closing quote")
+}
+
+// expandEnv replaces ${VAR} and $VAR in value with the values of the
+// environment variables, and $$ with $.
+func expandEnv(value string) string {
+	return os.Expand(value, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	})
 }
 
 func flagNameToEnvName(flagName string) string {
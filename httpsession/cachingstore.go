@@ -0,0 +1,173 @@
+package httpsession
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CachingStore is a [Store] that caches records of an underlying store
+// in memory, to avoid a round trip to a remote store on every request.
+//
+// Within a process, it guarantees read-your-writes: after Save returns nil,
+// Load returns the saved record, and after Delete is called, Load returns
+// not found even if a stale record was cached. A record that another
+// process saves to the underlying store may not be seen until it is
+// evicted from the cache, so CachingStore should be used only when
+// requests for a session are served by a single process, e.g. with
+// sticky sessions.
+//
+// CachingStore implements [Aliaser] and [Locker] whether or not the
+// underlying store does, and falls back to what [SessionStore] does without
+// them if it does not. It does not implement [Toucher], so sessions are
+// always saved with Save, which also refreshes the cache.
+type CachingStore[T any] struct {
+	store Store[T]
+	cache Store[T]
+
+	mu     sync.Mutex // guards writes; not held while calling store
+	writes map[string]*cacheWrites
+}
+
+// cacheWrites tracks calls in flight for an ID, so that a call that
+// finishes after a later write does not cache a stale record.
+type cacheWrites struct {
+	gen  uint64 // incremented by every write
+	refs int    // number of calls in flight
+}
+
+// NewCachingStore returns a new [CachingStore] that caches up to maxEntries
+// records of store. If maxEntries is not positive, the cache is unbounded.
+func NewCachingStore[T any](store Store[T], maxEntries int) *CachingStore[T] {
+	return &CachingStore[T]{
+		store:  store,
+		cache:  NewMemoryStore[T](WithMaxEntries(maxEntries)),
+		writes: make(map[string]*cacheWrites),
+	}
+}
+
+// begin registers a call for id and returns the generation of id.
+// If write is true, the call is a write and increments the generation.
+// s.mu must be held.
+func (s *CachingStore[T]) begin(id string, write bool) uint64 {
+	w := s.writes[id]
+	if w == nil {
+		w = new(cacheWrites)
+		s.writes[id] = w
+	}
+	if write {
+		w.gen++
+	}
+	w.refs++
+	return w.gen
+}
+
+// end unregisters a call for id started by begin, and reports whether
+// no write for id has begun since then. s.mu must be held.
+func (s *CachingStore[T]) end(id string, gen uint64) (latest bool) {
+	w := s.writes[id]
+	if w.refs--; w.refs == 0 {
+		delete(s.writes, id)
+	}
+	return w.gen == gen
+}
+
+func (s *CachingStore[T]) Load(ctx context.Context, id string, ret *Record[T]) (found bool, err error) {
+	if found, err := s.cache.Load(ctx, id, ret); err != nil || found {
+		return found, err
+	}
+	s.mu.Lock()
+	gen := s.begin(id, false)
+	s.mu.Unlock()
+	found, err = s.store.Load(ctx, id, ret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Do not cache what a concurrent write may have made stale.
+	if s.end(id, gen) && err == nil && found {
+		if err := s.cache.Save(ctx, ret); err != nil {
+			return false, err
+		}
+	}
+	return found, err
+}
+
+// Save saves r to the underlying store and then to the cache.
+// If the underlying store fails, the cached record is evicted,
+// since the state of the underlying store is unknown.
+// The cached record is also evicted if another write for r.ID begins
+// while saving, since the order of the writes in the underlying store is unknown.
+func (s *CachingStore[T]) Save(ctx context.Context, r *Record[T]) error {
+	s.mu.Lock()
+	gen := s.begin(r.ID, true)
+	s.mu.Unlock()
+	err := s.store.Save(ctx, r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.end(r.ID, gen) || err != nil {
+		s.cache.Delete(ctx, r.ID)
+		return err
+	}
+	return s.cache.Save(ctx, r)
+}
+
+// Delete evicts the record from the cache and deletes it from the underlying store.
+func (s *CachingStore[T]) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	gen := s.begin(id, true)
+	err := s.cache.Delete(ctx, id)
+	s.mu.Unlock()
+	if err == nil {
+		err = s.store.Delete(ctx, id)
+	}
+	s.mu.Lock()
+	s.end(id, gen)
+	s.mu.Unlock()
+	return err
+}
+
+// DeleteExpired deletes expired records in the cache and the underlying store.
+func (s *CachingStore[T]) DeleteExpired(ctx context.Context) error {
+	if err := s.cache.DeleteExpired(ctx); err != nil {
+		return err
+	}
+	return s.store.DeleteExpired(ctx)
+}
+
+// Alias evicts the record of oldID from the cache and calls Alias of the
+// underlying store, or Delete if it does not implement [Aliaser].
+// Loading oldID then loads the record of newID from the underlying store.
+func (s *CachingStore[T]) Alias(ctx context.Context, oldID, newID string, deadline time.Time) error {
+	a, ok := s.store.(Aliaser)
+	if !ok {
+		return s.Delete(ctx, oldID)
+	}
+	s.mu.Lock()
+	gen := s.begin(oldID, true)
+	err := s.cache.Delete(ctx, oldID)
+	s.mu.Unlock()
+	if err == nil {
+		err = a.Alias(ctx, oldID, newID, deadline)
+	}
+	s.mu.Lock()
+	s.end(oldID, gen)
+	s.mu.Unlock()
+	return err
+}
+
+// Lock calls Lock of the underlying store, or does nothing
+// if it does not implement [Locker].
+func (s *CachingStore[T]) Lock(ctx context.Context, id string) (unlock func(), err error) {
+	l, ok := s.store.(Locker)
+	if !ok {
+		return func() {}, nil
+	}
+	return l.Lock(ctx, id)
+}
+
+// CheckType calls CheckType of the underlying store if it implements [TypeChecker].
+func (s *CachingStore[T]) CheckType() error {
+	if c, ok := s.store.(TypeChecker); ok {
+		return c.CheckType()
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package httpsession
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCachingStore(t *testing.T) {
+	ctx := t.Context()
+	backend := newMemoryStore[testSession]()
+	var loads int
+	var saveErr error
+	store := NewCachingStore[testSession](&mockStore[testSession]{
+		LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+			loads++
+			return backend.Load(ctx, id, r)
+		},
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+			if saveErr != nil {
+				return saveErr
+			}
+			return backend.Save(ctx, r)
+		},
+		DeleteFunc: backend.Delete,
+	}, 10)
+
+	load := func() (int, bool) {
+		t.Helper()
+		var r Record[testSession]
+		found, err := store.Load(ctx, "id", &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Session.N, found
+	}
+	save := func(n int) error {
+		r := &Record[testSession]{ID: "id", IdleDeadline: time.Now().Add(time.Hour)}
+		r.Session.N = n
+		return store.Save(ctx, r)
+	}
+
+	// Read-your-writes after Save, served from the cache.
+	for _, n := range []int{1, 2} {
+		if err := save(n); err != nil {
+			t.Fatal(err)
+		}
+		if got, found := load(); !found || got != n {
+			t.Errorf("got %v, %v; want %v, true", got, found, n)
+		}
+	}
+	if loads != 0 {
+		t.Errorf("underlying store was loaded %v times; want 0", loads)
+	}
+
+	// A failed Save evicts the cached record.
+	saveErr = errors.New("down")
+	if err := save(3); err == nil {
+		t.Fatal("expected error")
+	}
+	saveErr = nil
+	if got, found := load(); !found || got != 2 {
+		t.Errorf("got %v, %v; want 2, true", got, found)
+	}
+	if loads != 1 {
+		t.Errorf("underlying store was loaded %v times; want 1", loads)
+	}
+
+	// Delete evicts the cached record.
+	if _, found := load(); !found {
+		t.Fatal("record not cached")
+	}
+	if err := store.Delete(ctx, "id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := load(); found {
+		t.Error("found a deleted record")
+	}
+}
+
+func TestCachingStoreConcurrentWrites(t *testing.T) {
+	ctx := t.Context()
+	backend := newMemoryStore[testSession]()
+	var loads int
+	blocked, unblock := make(chan struct{}), make(chan struct{})
+	store := NewCachingStore[testSession](&mockStore[testSession]{
+		LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+			loads++
+			return backend.Load(ctx, id, r)
+		},
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+			if r.Session.N == 1 {
+				blocked <- struct{}{}
+				<-unblock
+			}
+			return backend.Save(ctx, r)
+		},
+		DeleteFunc: backend.Delete,
+	}, 10)
+	save := func(id string, n int) error {
+		r := &Record[testSession]{ID: id, IdleDeadline: time.Now().Add(time.Hour)}
+		r.Session.N = n
+		return store.Save(ctx, r)
+	}
+
+	done := make(chan error)
+	go func() { done <- save("id", 1) }()
+	<-blocked
+
+	// The slow Save does not block other calls.
+	if err := save("other", 2); err != nil {
+		t.Fatal(err)
+	}
+	var r Record[testSession]
+	if found, err := store.Load(ctx, "other", &r); err != nil || !found || r.Session.N != 2 {
+		t.Fatalf("Load() = %v, %v, %v; want true, nil, 2", found, err, r.Session.N)
+	}
+	if err := save("id", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// The slow Save finishes after a later write, so it must not be cached.
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if found, err := store.Load(ctx, "id", &r); err != nil || !found || r.Session.N != 1 {
+		t.Fatalf("Load() = %v, %v, %v; want true, nil, 1", found, err, r.Session.N)
+	}
+	if loads != 1 {
+		t.Errorf("underlying store was loaded %v times; want 1", loads)
+	}
+	if len(store.writes) != 0 {
+		t.Errorf("got %v IDs in flight; want 0", len(store.writes))
+	}
+}
+
+func TestCachingStoreAlias(t *testing.T) {
+	ctx := t.Context()
+	backend := newMemoryStore[testSession]()
+	store := NewCachingStore[testSession](backend, 10)
+	deadline := time.Now().Add(time.Hour)
+	for _, id := range []string{"old", "new"} {
+		r := &Record[testSession]{ID: id, IdleDeadline: deadline}
+		r.Session.N = len(id)
+		if err := store.Save(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Alias(ctx, "old", "new", deadline); err != nil {
+		t.Fatal(err)
+	}
+	var r Record[testSession]
+	if found, err := store.Load(ctx, "old", &r); err != nil || !found || r.ID != "new" {
+		t.Errorf("Load() = %v, %v, %q; want true, nil, %q", found, err, r.ID, "new")
+	}
+}
@@ -0,0 +1,148 @@
+package httpsession
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// FallbackStore is a [Store] that serves sessions from a fallback store,
+// an in-memory store by default, while its primary store is unavailable.
+//
+// After Threshold consecutive failures of the primary store, it switches to
+// the fallback store and logs an error. Every RetryInterval, the next
+// operation tries the primary store again and switches back on success.
+// Sessions saved during an outage are lost when switching back,
+// so users may be logged out twice.
+// Errors such as [ErrIDConflict] do not count as failures,
+// since the primary store is working.
+type FallbackStore[T any] struct {
+	// Threshold is the number of consecutive failures that switch
+	// to the fallback store. The default is 3.
+	Threshold int
+	// RetryInterval is the interval at which the primary store is retried
+	// during an outage. The default is 30 seconds.
+	RetryInterval time.Duration
+	// Logger is used to log switching between the stores.
+	// If nil, [slog.Default] is used.
+	Logger *slog.Logger
+
+	primary  Store[T]
+	fallback Store[T]
+	now      func() time.Time // for tests
+
+	mu       sync.Mutex
+	failures int
+	degraded bool
+	retryAt  time.Time
+}
+
+// NewFallbackStore returns a new [FallbackStore] that falls back to fallback
+// when primary fails. If fallback is nil, an in-memory store is used.
+func NewFallbackStore[T any](primary, fallback Store[T]) *FallbackStore[T] {
+	if fallback == nil {
+		fallback = NewMemoryStore[T]()
+	}
+	return &FallbackStore[T]{
+		Threshold:     3,
+		RetryInterval: 30 * time.Second,
+		primary:       primary,
+		fallback:      fallback,
+		now:           time.Now,
+	}
+}
+
+func (s *FallbackStore[T]) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// do calls fn with the primary store unless it is unavailable,
+// and with the fallback store otherwise. It reports whether fn was called
+// with the fallback store.
+func (s *FallbackStore[T]) do(ctx context.Context, fn func(Store[T]) error) (usedFallback bool, err error) {
+	s.mu.Lock()
+	usePrimary := !s.degraded || !s.now().Before(s.retryAt)
+	if s.degraded && usePrimary {
+		// let other operations use the fallback store while retrying.
+		s.retryAt = s.now().Add(s.RetryInterval)
+	}
+	s.mu.Unlock()
+	if !usePrimary {
+		return true, fn(s.fallback)
+	}
+
+	err = fn(s.primary)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil || isLogicalError(err) {
+		if s.degraded {
+			s.logger().InfoContext(ctx, "httpsession: primary store recovered")
+		}
+		s.failures = 0
+		s.degraded = false
+		return false, err
+	}
+	s.failures++
+	if !s.degraded && s.failures < s.Threshold {
+		return false, err
+	}
+	if !s.degraded {
+		s.logger().ErrorContext(ctx, "httpsession: primary store is unavailable; falling back: "+err.Error())
+	}
+	s.degraded = true
+	s.retryAt = s.now().Add(s.RetryInterval)
+	return true, fn(s.fallback)
+}
+
+// Degraded reports whether s is serving sessions from the fallback store.
+func (s *FallbackStore[T]) Degraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.degraded
+}
+
+func (s *FallbackStore[T]) Load(ctx context.Context, id string, ret *Record[T]) (found bool, err error) {
+	_, err = s.do(ctx, func(store Store[T]) error {
+		found, err = store.Load(ctx, id, ret)
+		return err
+	})
+	return found, err
+}
+
+func (s *FallbackStore[T]) Save(ctx context.Context, r *Record[T]) error {
+	_, err := s.do(ctx, func(store Store[T]) error {
+		return store.Save(ctx, r)
+	})
+	return err
+}
+
+func (s *FallbackStore[T]) Delete(ctx context.Context, id string) error {
+	_, err := s.do(ctx, func(store Store[T]) error {
+		return store.Delete(ctx, id)
+	})
+	return err
+}
+
+// DeleteExpired deletes expired records in both stores.
+func (s *FallbackStore[T]) DeleteExpired(ctx context.Context) error {
+	usedFallback, err := s.do(ctx, func(store Store[T]) error {
+		return store.DeleteExpired(ctx)
+	})
+	if usedFallback {
+		return err
+	}
+	return errors.Join(err, s.fallback.DeleteExpired(ctx))
+}
+
+// CheckType calls CheckType of the primary store if it implements [TypeChecker].
+func (s *FallbackStore[T]) CheckType() error {
+	if c, ok := s.primary.(TypeChecker); ok {
+		return c.CheckType()
+	}
+	return nil
+}
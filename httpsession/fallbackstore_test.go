@@ -0,0 +1,161 @@
+package httpsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFallbackStore(t *testing.T) {
+	healthy := newMemoryStore[testSession]()
+	failing := true
+	errDown := errors.New("down")
+	primary := &mockStore[testSession]{
+		LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+			if failing {
+				return false, errDown
+			}
+			return healthy.Load(ctx, id, r)
+		},
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+			if failing {
+				return errDown
+			}
+			return healthy.Save(ctx, r)
+		},
+	}
+	store := NewFallbackStore[testSession](primary, nil)
+	store.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	var errs int
+	session := New[testSession]()
+	session.Store = store
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		errs++
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+	serve := func(cookie *http.Cookie) *http.Cookie {
+		r := httptest.NewRequest("GET", "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			return cookies[0]
+		}
+		return nil
+	}
+
+	// Failures below Threshold are reported.
+	for range store.Threshold - 1 {
+		serve(nil)
+	}
+	if errs != store.Threshold-1 || store.Degraded() {
+		t.Fatalf("got %v errors, degraded = %v; want %v, false", errs, store.Degraded(), store.Threshold-1)
+	}
+
+	// Then sessions are served from the fallback store.
+	errs = 0
+	cookie := serve(nil)
+	cookie = serve(cookie)
+	if errs != 0 || !store.Degraded() {
+		t.Fatalf("got %v errors, degraded = %v; want 0, true", errs, store.Degraded())
+	}
+	var r Record[testSession]
+	if found, _ := store.fallback.Load(t.Context(), cookie.Value, &r); !found || r.Session.N != 2 {
+		t.Fatalf("got %v, %+v in fallback store", found, r)
+	}
+
+	// The primary store is retried after RetryInterval.
+	failing = false
+	serve(cookie)
+	if !store.Degraded() {
+		t.Fatal("switched back before RetryInterval")
+	}
+	now = now.Add(store.RetryInterval)
+	cookie = serve(nil)
+	if errs != 0 || store.Degraded() {
+		t.Fatalf("got %v errors, degraded = %v; want 0, false", errs, store.Degraded())
+	}
+	if _, ok := healthy.m[cookie.Value]; !ok {
+		t.Error("session not saved in primary store")
+	}
+}
+
+func TestFallbackStoreLogicalError(t *testing.T) {
+	primary := &mockStore[testSession]{
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+			return fmt.Errorf("save %s: %w", r.ID, ErrIDConflict)
+		},
+	}
+	store := NewFallbackStore[testSession](primary, nil)
+	for range store.Threshold + 1 {
+		if err := store.Save(t.Context(), &Record[testSession]{ID: "id"}); !errors.Is(err, ErrIDConflict) {
+			t.Fatalf("got %v; want %v", err, ErrIDConflict)
+		}
+	}
+	if store.Degraded() {
+		t.Error("switched to the fallback store on ErrIDConflict")
+	}
+}
+
+// uncomparableStore is a store whose dynamic type is not comparable.
+type uncomparableStore struct {
+	*mockStore[testSession]
+	_ []int
+}
+
+func TestFallbackStoreDeleteExpired(t *testing.T) {
+	var primaryCalls, fallbackCalls int
+	failing := false
+	primary := uncomparableStore{mockStore: &mockStore[testSession]{
+		DeleteExpiredFunc: func(ctx context.Context) error {
+			primaryCalls++
+			if failing {
+				return errors.New("down")
+			}
+			return nil
+		},
+	}}
+	fallback := uncomparableStore{mockStore: &mockStore[testSession]{
+		DeleteExpiredFunc: func(ctx context.Context) error {
+			fallbackCalls++
+			return nil
+		},
+	}}
+	store := NewFallbackStore[testSession](primary, fallback)
+	store.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	if err := store.DeleteExpired(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if primaryCalls != 1 || fallbackCalls != 1 {
+		t.Fatalf("got %v, %v calls; want 1, 1", primaryCalls, fallbackCalls)
+	}
+
+	failing = true
+	for range store.Threshold - 1 {
+		if err := store.DeleteExpired(t.Context()); err == nil {
+			t.Fatal("got nil error below Threshold")
+		}
+	}
+	primaryCalls, fallbackCalls = 0, 0
+	if err := store.DeleteExpired(t.Context()); err != nil || !store.Degraded() {
+		t.Fatalf("got %v, degraded = %v; want nil, true", err, store.Degraded())
+	}
+	if primaryCalls != 1 || fallbackCalls != 1 {
+		t.Errorf("got %v, %v calls; want 1, 1", primaryCalls, fallbackCalls)
+	}
+}
@@ -2,12 +2,23 @@
 package httpsession
 
 import (
+	"bufio"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"log/slog"
+	mathrand "math/rand/v2"
+	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +30,9 @@ type Store[T any] interface {
 	Load(ctx context.Context, id string, ret *Record[T]) (found bool, err error)
 
 	// Save saves a session record r.
+	// If the store detects that r.ID is used by another session, or that the
+	// record was changed concurrently since it was loaded, it returns an error
+	// that wraps ErrIDConflict.
 	Save(ctx context.Context, r *Record[T]) error
 
 	// Delete deletes a session record associated with id.
@@ -28,19 +42,156 @@ type Store[T any] interface {
 	DeleteExpired(ctx context.Context) error
 }
 
+// Errors that a [Store] returns for logical failures, as opposed to failures
+// of the underlying storage, wrapped in an error with details if needed.
+// Callers should test for them with [errors.Is].
+var (
+	// ErrRecordNotFound is returned by methods that need an existing record,
+	// such as store-specific ones, when the record does not exist.
+	// Store.Load reports a missing record with found == false instead,
+	// but Handler also treats ErrRecordNotFound from Load as not found.
+	ErrRecordNotFound = errors.New("httpsession: record not found")
+	// ErrIDConflict is returned by Store.Save when the ID of the record is
+	// used by another session or the record was changed concurrently.
+	ErrIDConflict = errors.New("httpsession: session ID conflict")
+)
+
+// isLogicalError reports whether err is one of the errors a Store returns
+// while it works correctly.
+func isLogicalError(err error) bool {
+	return errors.Is(err, ErrRecordNotFound) || errors.Is(err, ErrIDConflict)
+}
+
+// TypeChecker is an optional interface implemented by a [Store]
+// that can check in advance whether it is able to encode sessions of its type.
+// [SessionStore.Handler] calls CheckType once and panics if it returns an error.
+type TypeChecker interface {
+	CheckType() error
+}
+
+// Toucher is an optional interface implemented by a [Store]
+// that can update the idle deadline of a record without rewriting its session.
+// It is used to save a session that has not been modified, e.g. after [SessionStore.Touch].
+type Toucher interface {
+	// Touch updates the idle deadline of a session record associated with id.
+	// If not found, it does nothing.
+	Touch(ctx context.Context, id string, idleDeadline time.Time) error
+}
+
+// BatchDeleter is an optional interface implemented by a [Store]
+// that can delete expired records in limited batches, so that deleting
+// many records does not hold a lock on the store for long.
+// It is used by [SessionStore.Cleanup] instead of DeleteExpired.
+type BatchDeleter interface {
+	// DeleteExpiredBatch deletes at most limit expired session records
+	// and returns the number of deleted records.
+	DeleteExpiredBatch(ctx context.Context, limit int) (deleted int, err error)
+}
+
+// Transport is the interface that carries session tokens between
+// clients and the middleware instead of cookies.
+// A token is the session ID without namespace, signed if SignKey is set.
+type Transport interface {
+	// Extract returns the session token sent with r.
+	// If r has no token, it returns false.
+	Extract(r *http.Request) (token string, ok bool)
+
+	// Inject sends token to the client.
+	// deadline is the time after which the client can discard token.
+	Inject(w http.ResponseWriter, token string, deadline time.Time)
+
+	// Clear tells the client to discard its token.
+	Clear(w http.ResponseWriter)
+}
+
+// HeaderTransport is a [Transport] that carries session tokens in an HTTP header,
+// e.g. "Authorization: Bearer <token>".
+// The token is sent back to the client in the same header of the response.
+type HeaderTransport struct {
+	// Name is the name of the header.
+	Name string
+	// Scheme, if not empty, is the authentication scheme preceding the token,
+	// e.g. "Bearer".
+	Scheme string
+}
+
+// Extract implements [Transport].
+func (t HeaderTransport) Extract(r *http.Request) (string, bool) {
+	values := r.Header.Values(t.Name)
+	if len(values) != 1 {
+		return "", false
+	}
+	token := values[0]
+	if t.Scheme != "" {
+		scheme, rest, ok := strings.Cut(token, " ")
+		if !ok || !strings.EqualFold(scheme, t.Scheme) {
+			return "", false
+		}
+		token = strings.TrimLeft(rest, " ")
+	}
+	return token, token != ""
+}
+
+// Inject implements [Transport]. deadline is ignored.
+func (t HeaderTransport) Inject(w http.ResponseWriter, token string, deadline time.Time) {
+	if t.Scheme != "" {
+		token = t.Scheme + " " + token
+	}
+	w.Header().Set(t.Name, token)
+}
+
+// Clear implements [Transport] by setting the header to an empty value.
+func (t HeaderTransport) Clear(w http.ResponseWriter) {
+	w.Header().Set(t.Name, "")
+}
+
+// Aliaser is an optional interface implemented by a [Store]
+// that can make an ID refer to the record of another ID for a while.
+// It is used by [SessionStore.RenewID] if RenewGracePeriod is set.
+type Aliaser interface {
+	// Alias replaces the record associated with oldID with an alias
+	// to the record associated with newID, which expires at deadline.
+	// Until then, loading oldID loads the record of newID.
+	Alias(ctx context.Context, oldID, newID string, deadline time.Time) error
+}
+
+// Locker is an optional interface implemented by a [Store]
+// that can lock a session across processes sharing the store.
+// [SessionStore.Handler] locks the session sent with a request before
+// loading it and unlocks it after saving it, so that concurrent requests
+// for the same session modify it one at a time, even if they are served by
+// different processes. Such requests wait for the lock instead of being
+// rejected as they are without a Locker. Requests for which ReadOnlyRequest
+// reports true do not lock.
+type Locker interface {
+	// Lock blocks until it locks id or ctx is done.
+	// On success, the caller must call unlock to release the lock.
+	Lock(ctx context.Context, id string) (unlock func(), err error)
+}
+
 // Record holds information about an HTTP session.
 type Record[T any] struct {
-	bits uint8
+	bits      uint8
+	active    *activeSession
+	sameSite  http.SameSite
+	keyPrefix string // namespace prefix of ID
 
 	ID               string
 	IdleDeadline     time.Time
 	AbsoluteDeadline time.Time
 	Session          T
+	// Flashes holds one-time messages added by [SessionStore.Flash].
+	Flashes []string
 }
 
 const (
 	recordModified = 1 << iota
 	recordDeleted
+	recordCookieChanged
+	recordTouched
+	recordNew
+	recordReadOnlyRequest
+	recordRenewed
 )
 
 func (r *Record[T]) readOnly() bool {
@@ -51,6 +202,22 @@ func (r *Record[T]) deleted() bool {
 	return r.bits&recordDeleted != 0
 }
 
+func (r *Record[T]) isNew() bool {
+	return r.bits&recordNew != 0
+}
+
+func (r *Record[T]) touched() bool {
+	return r.bits&recordTouched != 0
+}
+
+func (r *Record[T]) cookieChanged() bool {
+	return r.bits&recordCookieChanged != 0
+}
+
+func (r *Record[T]) invalidated() bool {
+	return r.active != nil && r.active.invalidated.Load()
+}
+
 func (r *Record[T]) setBit(bit uint8, ok bool) {
 	if ok {
 		r.bits |= bit
@@ -59,32 +226,182 @@ func (r *Record[T]) setBit(bit uint8, ok bool) {
 	}
 }
 
-func (r *Record[T]) init(deadline time.Time) {
+// mustWritable panics if r is used by a request marked by ReadOnlyRequest.
+func (r *Record[T]) mustWritable() {
+	if r.bits&recordReadOnlyRequest != 0 {
+		panic("httpsession: session modified in a read-only request")
+	}
+}
+
+func (r *Record[T]) init(id string, deadline time.Time) {
 	var zero T
-	r.ID = rand.Text()
+	r.ID = id
+	r.setBit(recordNew, true)
+	r.setBit(recordCookieChanged, true)
 	r.IdleDeadline = time.Time{} // just in case
 	r.AbsoluteDeadline = deadline
 	r.Session = zero
+	r.Flashes = nil
 }
 
-func defaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
-	slog.ErrorContext(r.Context(), "httpsession: "+err.Error())
+func (m *SessionStore[T]) defaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	m.logger().ErrorContext(r.Context(), "httpsession: "+err.Error())
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
 // SessionStore is a net/http middleware that automatically tracks HTTP sessions.
 type SessionStore[T any] struct {
 	// IdleTimeout defines the amount of time a session will remain active.
+	// Use SetIdleTimeout to change it after Handler was called.
 	IdleTimeout time.Duration
 	// AbsoluteTimeout defines the maximum amount of time a session can be active.
+	// If zero, sessions have no absolute timeout and expire only when idle;
+	// their Record.AbsoluteDeadline is 9999-12-31, which Store must be able to save.
+	// A negative value makes new sessions expire immediately.
+	// Use SetAbsoluteTimeout to change it after Handler was called.
 	// See https://github.com/OWASP/CheatSheetSeries/blob/master/cheatsheets/Session_Management_Cheat_Sheet.md#absolute-timeout
 	AbsoluteTimeout time.Duration
+	// IdleDeadlinePrecision, if positive, makes a session that was only read
+	// be saved to extend its idle deadline, but only when the deadline would
+	// advance by at least IdleDeadlinePrecision.
+	// Sessions modified through Get are always saved.
+	IdleDeadlinePrecision time.Duration
+	// SlideIdleDeadline makes every save of a session extend its idle
+	// deadline to IdleTimeout from now. If false, the idle deadline is
+	// extended only when more than half of IdleTimeout has elapsed since
+	// it was last extended, which reduces writes by chatty clients,
+	// e.g. combined with IdleDeadlinePrecision.
+	// The default set by [New] is true.
+	SlideIdleDeadline bool
+	// CookieOnlyOnChange makes the middleware set the cookie only when
+	// the session ID changes, instead of on every save.
+	// The Max-Age of the cookie is then derived from the absolute deadline,
+	// and the idle timeout is enforced only on the server side.
+	// It is useful for APIs to reduce response sizes, especially
+	// with IdleDeadlinePrecision.
+	CookieOnlyOnChange bool
 	// SetCookie is used as a template for a Set-Cookie header.
-	SetCookie    http.Cookie
-	Store        Store[T]
+	SetCookie http.Cookie
+	// Transport, if not nil, carries session tokens instead of cookies,
+	// and SetCookie is not used.
+	// SetCookieSameSite has no effect with Transport.
+	Transport Transport
+	Store     Store[T]
+	// Namespace, if not nil, returns a namespace of the session of a request,
+	// e.g. a tenant name. A non-empty namespace ns is prepended to session IDs
+	// as ns+":"+id in Store calls and [Record.ID], but not in cookies,
+	// so that sessions of different namespaces are isolated even if they
+	// share a store and a cookie value.
+	Namespace func(r *http.Request) string
+	// SignKey, if not nil, is used to sign cookie values with HMAC-SHA256.
+	// Cookies with an invalid signature are treated as if the session was not found,
+	// without calling Store.Load.
+	// Changing SignKey invalidates all existing cookies.
+	SignKey []byte
+	// IDGenerator returns a new session ID.
+	// It must return a unique and unpredictable string.
+	// The default is [rand.Text].
+	IDGenerator func() string
+	// MaxIDLength, if positive, is the maximum length of a session ID sent by
+	// a client, including its signature. Longer IDs are treated as if
+	// the session was not found, without calling Store.Load.
+	// The default is 128.
+	MaxIDLength int
+	// IDValidator, if not nil, reports whether id is well-formed.
+	// A session ID sent by a client that is not well-formed is treated as if
+	// the session was not found, without calling Store.Load.
+	// IDs returned by IDGenerator or passed to RenewID are also checked.
+	// A custom IDGenerator should come with a matching IDValidator.
+	// The default accepts [DefaultIDAlphabet], which covers [rand.Text].
+	IDValidator func(id string) bool
+	// Logger is used to log errors that cannot be reported to ErrorHandler,
+	// and by the default ErrorHandler.
+	// If nil, [slog.Default] is used.
+	Logger *slog.Logger
+	// OnCreate, if not nil, is called when a new session is created
+	// because no valid session was found.
+	OnCreate func(ctx context.Context, id string)
+	// OnLoad, if not nil, is called when a valid session is loaded from Store.
+	OnLoad func(ctx context.Context, id string)
+	// OnRenew, if not nil, is called after the session ID is renewed by Renew or RenewID.
+	OnRenew func(ctx context.Context, oldID, newID string)
+	// OnDelete, if not nil, is called after the session is deleted by Delete.
+	OnDelete func(ctx context.Context, id string)
+	// AfterSave, if not nil, is called after the session is saved to Store,
+	// with the request being served, e.g. to emit an audit event with its
+	// client IP and path. It is called whether the session is saved before
+	// the response is written or after the handler returned without writing.
+	AfterSave func(w http.ResponseWriter, r *http.Request, record *Record[T])
+	// OnSaveError, if not nil, is called when the session cannot be saved
+	// to Store, before the error is passed to ErrorHandler.
+	// Like the other hooks, it is meant for cheap work such as counting
+	// events for metrics.
+	OnSaveError func(ctx context.Context, id string, err error)
+	// ReadOnlyRequest, if not nil, reports whether r only reads the session,
+	// e.g. an idempotent GET. Such requests bypass the check that rejects
+	// concurrent requests for the same session, so they can run in parallel.
+	// The session is never saved and no cookie is set for them,
+	// and methods that modify the session, such as Get, panic.
+	ReadOnlyRequest func(r *http.Request) bool
+	// AllowConcurrent makes Handler serve concurrent requests for the same
+	// session instead of rejecting all but the first one with ErrorHandler.
+	// Each request works on its own copy of the session, and the last one
+	// to save it wins, so changes made by the others may be lost.
+	// Use a Store that implements [Locker] to serialize such requests instead.
+	AllowConcurrent bool
+	// ShouldSetCookie, if not nil, reports whether the session cookie may be set
+	// in the response to r, e.g. whether the user has consented to cookies.
+	// If it returns false, no cookie is set, so the session does not persist
+	// across requests, and the session is saved only if SaveWithoutCookie is true.
+	// An expired cookie is still set to delete a session.
+	ShouldSetCookie func(r *http.Request) bool
+	// SaveWithoutCookie makes the session be saved in Store even if
+	// ShouldSetCookie returns false, e.g. to keep data of the request
+	// available to other components by its ID. Otherwise the save is skipped.
+	SaveWithoutCookie bool
+	// RenewGracePeriod, if positive and Store implements [Aliaser],
+	// makes RenewID keep the old session ID as an alias of the new one
+	// for the period instead of deleting it, so that a concurrent or retried
+	// request with the old cookie still finds the session and receives
+	// the new cookie.
+	RenewGracePeriod time.Duration
+	// RotateEveryRequest makes the middleware renew the ID of a session
+	// loaded from Store whenever a response sets the session cookie,
+	// as if Renew was called, but without resetting the absolute deadline.
+	// A stolen cookie then becomes useless once its owner makes a request.
+	// A request sent with the old cookie, e.g. by another tab at the same time,
+	// starts a new session, unless RenewGracePeriod is set with an [Aliaser]
+	// and the request that rotated the ID has finished, in which case it
+	// loads the session and also receives a new ID. Read-only requests do
+	// not rotate.
+	RotateEveryRequest bool
+	// TrustedProxyHeaders lists the request headers set by a trusted reverse proxy
+	// that ClientIP and AutoSecure honor.
+	// Supported headers are "X-Forwarded-For", "X-Real-Ip" and "X-Forwarded-Proto".
+	// Headers not listed are ignored, because clients can forge them
+	// unless a proxy overwrites them.
+	TrustedProxyHeaders []string
+	// AutoSecure makes the middleware set the Secure attribute of session
+	// cookies only for requests sent over HTTPS, overriding SetCookie.Secure,
+	// so that the same settings work over plain HTTP during development.
+	// A request is sent over HTTPS if it has TLS, or if "X-Forwarded-Proto"
+	// is in TrustedProxyHeaders and is "https".
+	// Cookies named with HostPrefix or SecurePrefix are always Secure.
+	AutoSecure bool
+	// CleanupBatchSize is the maximum number of records deleted at once
+	// by Cleanup if Store implements [BatchDeleter].
+	// Cleanup deletes batches until a batch is not full.
+	// The default is 1000.
+	CleanupBatchSize int
+	// ErrorHandler is called when the middleware fails to load or save a session.
+	// Once ErrorHandler has been called, no Set-Cookie header for the session
+	// is added to the response, even if the handler continues writing.
 	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
 
-	active     sync.Map         // string -> struct{}
+	idleTimeoutOverride     atomic.Pointer[time.Duration] // set by SetIdleTimeout
+	absoluteTimeoutOverride atomic.Pointer[time.Duration] // set by SetAbsoluteTimeout
+
+	active     sync.Map         // string -> *activeSession
 	now        func() time.Time // for tests
 	recordPool sync.Pool
 }
@@ -95,13 +412,77 @@ type SessionStore[T any] struct {
 // SetCookie.Name.
 const DefaultCookieName = "id"
 
+// DefaultIDAlphabet is the set of characters accepted by
+// the default IDValidator of [SessionStore], the characters of base64url encoding.
+const DefaultIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// AlphabetValidator returns an IDValidator that accepts non-empty IDs
+// consisting of characters in alphabet.
+func AlphabetValidator(alphabet string) func(id string) bool {
+	return func(id string) bool {
+		for _, c := range id {
+			if !strings.ContainsRune(alphabet, c) {
+				return false
+			}
+		}
+		return id != ""
+	}
+}
+
+// Cookie name prefixes.
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Set-Cookie#cookie_prefixes
+const (
+	HostPrefix   = "__Host-"
+	SecurePrefix = "__Secure-"
+)
+
+// SetCookieName sets m.SetCookie.Name to prefix+name, e.g.
+// SetCookieName(HostPrefix, "app") sets "__Host-app".
+// prefix must be "", [HostPrefix] or [SecurePrefix].
+// It returns an error if m.SetCookie does not satisfy the requirements of prefix,
+// in which case m.SetCookie is not modified.
+// The default attributes of [New] satisfy both prefixes.
+func (m *SessionStore[T]) SetCookieName(prefix, name string) error {
+	if prefix != "" && prefix != HostPrefix && prefix != SecurePrefix {
+		return fmt.Errorf("httpsession: unknown cookie name prefix %q", prefix)
+	}
+	cookie := m.SetCookie
+	cookie.Name = prefix + name
+	if err := validateCookie(&cookie); err != nil {
+		return err
+	}
+	m.SetCookie.Name = cookie.Name
+	return nil
+}
+
+// validateCookie reports whether c satisfies the requirements of its name prefix.
+func validateCookie(c *http.Cookie) error {
+	if err := c.Valid(); err != nil {
+		return fmt.Errorf("httpsession: %v", err)
+	}
+	switch {
+	case strings.HasPrefix(c.Name, HostPrefix):
+		if !c.Secure || c.Path != "/" || c.Domain != "" {
+			return fmt.Errorf("httpsession: cookie %q requires Secure, Path=/ and no Domain", c.Name)
+		}
+	case strings.HasPrefix(c.Name, SecurePrefix):
+		if !c.Secure {
+			return fmt.Errorf("httpsession: cookie %q requires Secure", c.Name)
+		}
+	}
+	return nil
+}
+
 // New returns a new instance of [SessionStore] with default settings.
 func New[T any]() *SessionStore[T] {
-	return &SessionStore[T]{
-		IdleTimeout:     24 * time.Hour,
-		AbsoluteTimeout: 7 * 24 * time.Hour,
-		Store:           newMemoryStore[T](),
-		ErrorHandler:    defaultErrorHandler,
+	m := &SessionStore[T]{
+		IdleTimeout:       24 * time.Hour,
+		AbsoluteTimeout:   7 * 24 * time.Hour,
+		SlideIdleDeadline: true,
+		Store:             NewMemoryStore[T](),
+		IDGenerator:       rand.Text,
+		MaxIDLength:       128,
+		IDValidator:       AlphabetValidator(DefaultIDAlphabet),
 		SetCookie: http.Cookie{
 			Name:     DefaultCookieName,
 			Path:     "/",
@@ -117,39 +498,113 @@ func New[T any]() *SessionStore[T] {
 			},
 		},
 	}
+	m.ErrorHandler = m.defaultErrorHandler
+	return m
+}
+
+func (m *SessionStore[T]) logger() *slog.Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+	return slog.Default()
 }
 
 // Handler returns a middleware that automatically tracks HTTP sessions.
 // After it was called, m's fields must not be mutated.
+// Handler panics if m.SetCookie does not satisfy the requirements of
+// the prefix of its name, such as [HostPrefix], since browsers would
+// silently reject the cookie.
 func (m *SessionStore[T]) Handler(next http.Handler) http.Handler {
+	if m.Transport == nil {
+		if err := validateCookie(&m.SetCookie); err != nil {
+			panic(err.Error())
+		}
+	}
+	if c, ok := m.Store.(TypeChecker); ok {
+		if err := c.CheckType(); err != nil {
+			var zero T
+			panic(fmt.Sprintf("httpsession: session type %T cannot be encoded by the store: %v", zero, err))
+		}
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		record := m.getRecord()
 		defer m.putRecord(record)
 
+		var keyPrefix string
+		if m.Namespace != nil {
+			if ns := m.Namespace(r); ns != "" {
+				keyPrefix = ns + ":"
+			}
+		}
+
 		var found bool
 		var err error
-		if cookies := r.CookiesNamed(m.SetCookie.Name); len(cookies) == 1 {
-			found, err = m.Store.Load(r.Context(), cookies[0].Value, record)
-			if err != nil {
+		readOnly := m.ReadOnlyRequest != nil && m.ReadOnlyRequest(r)
+		ids := m.idsFromRequest(r)
+		locker, isLocker := m.Store.(Locker)
+		var unlock func()
+		defer func() {
+			if unlock != nil {
+				unlock()
+			}
+		}()
+		// Use the first candidate that resolves to a valid session.
+		for _, id := range ids {
+			if unlock != nil {
+				unlock()
+				unlock = nil
+			}
+			if isLocker && !readOnly {
+				if unlock, err = locker.Lock(r.Context(), keyPrefix+id); err != nil {
+					m.ErrorHandler(w, r, err)
+					return
+				}
+			}
+			if found, err = m.loadRecord(r.Context(), keyPrefix+id, record); err != nil {
 				m.ErrorHandler(w, r, err)
 				return
 			}
-			// if found && record.IdleDeadline.Before(m.now()) {
-			// 	found = false
-			// }
+			if found {
+				break
+			}
 		}
 		if !found {
-			record.init(m.now().Add(m.AbsoluteTimeout))
+			if err := m.initRecord(record, keyPrefix); err != nil {
+				m.ErrorHandler(w, r, err)
+				return
+			}
 		}
+		record.keyPrefix = keyPrefix
 
-		if _, loaded := m.active.LoadOrStore(record.ID, struct{}{}); loaded {
-			m.ErrorHandler(w, r, errors.New("httpsession: active session alreadly exists"))
-			return
+		if readOnly {
+			record.setBit(recordReadOnlyRequest, true)
+		} else {
+			active, ok := m.acquireActive(record.ID)
+			if !ok && found && m.RotateEveryRequest {
+				// Another request, e.g. from another tab, is about to rotate
+				// the ID, which this request could not use; start a new session.
+				found = false
+				if err := m.initRecord(record, keyPrefix); err != nil {
+					m.ErrorHandler(w, r, err)
+					return
+				}
+				active, ok = m.acquireActive(record.ID)
+			}
+			if !ok {
+				m.ErrorHandler(w, r, errors.New("httpsession: active session alreadly exists"))
+				return
+			}
+			defer m.releaseActive(record.ID, active)
+			record.active = active
 		}
-		defer m.active.Delete(record.ID)
 
 		ctx := m.newContextWithRecord(r.Context(), record)
 		r = r.WithContext(ctx)
+		if !found && m.OnCreate != nil {
+			m.OnCreate(ctx, record.ID)
+		} else if found && m.OnLoad != nil {
+			m.OnLoad(ctx, record.ID)
+		}
 		ss := &sessionSaver[T]{
 			ResponseWriter: w,
 			req:            r,
@@ -158,13 +613,133 @@ func (m *SessionStore[T]) Handler(next http.Handler) http.Handler {
 		next.ServeHTTP(ss, r)
 
 		if !ss.done && !ss.failed {
-			if err = m.ensureSave(r.Context()); err != nil {
-				slog.ErrorContext(ctx, "httpsession: failed to save a record: "+err.Error())
+			// next returned without writing anything,
+			// so ErrorHandler can still write the response.
+			if err = m.ensureSave(w, r); err != nil {
+				m.ErrorHandler(w, r, err)
 			}
 		}
 	})
 }
 
+// initRecord initializes record as a new session with a generated ID.
+func (m *SessionStore[T]) initRecord(record *Record[T], keyPrefix string) error {
+	id := m.IDGenerator()
+	if !m.validID(id) {
+		return fmt.Errorf("httpsession: IDGenerator returned an invalid ID %q", id)
+	}
+	record.init(keyPrefix+id, m.absoluteDeadline())
+	return nil
+}
+
+// SetIdleTimeout changes IdleTimeout safely while m is serving requests.
+// It affects idle deadlines computed after it returns.
+func (m *SessionStore[T]) SetIdleTimeout(d time.Duration) {
+	m.idleTimeoutOverride.Store(&d)
+}
+
+// SetAbsoluteTimeout changes AbsoluteTimeout safely while m is serving requests.
+// It affects sessions created or renewed after it returns.
+func (m *SessionStore[T]) SetAbsoluteTimeout(d time.Duration) {
+	m.absoluteTimeoutOverride.Store(&d)
+}
+
+func (m *SessionStore[T]) idleTimeout() time.Duration {
+	if d := m.idleTimeoutOverride.Load(); d != nil {
+		return *d
+	}
+	return m.IdleTimeout
+}
+
+func (m *SessionStore[T]) absoluteTimeout() time.Duration {
+	if d := m.absoluteTimeoutOverride.Load(); d != nil {
+		return *d
+	}
+	return m.AbsoluteTimeout
+}
+
+// noAbsoluteDeadline is the absolute deadline of sessions created while
+// AbsoluteTimeout is zero. It is a real time, rather than the zero time,
+// so that stores can save it as is.
+var noAbsoluteDeadline = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// absoluteDeadline returns the absolute deadline of a session created now.
+func (m *SessionStore[T]) absoluteDeadline() time.Time {
+	d := m.absoluteTimeout()
+	if d == 0 {
+		return noAbsoluteDeadline
+	}
+	return m.now().Add(d)
+}
+
+// HandlerFunc is like Handler but takes an [http.HandlerFunc].
+func (m *SessionStore[T]) HandlerFunc(next http.HandlerFunc) http.Handler {
+	return m.Handler(next)
+}
+
+// Then returns a middleware that wraps a handler with Handler and then
+// with middlewares in order, so that each of them can use the session:
+//
+//	mux.Handle("/", session.Then(csrf, logging)(app))
+//
+// serves a request with Handler, csrf, logging and app in this order.
+func (m *SessionStore[T]) Then(middlewares ...func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		for _, mw := range slices.Backward(middlewares) {
+			next = mw(next)
+		}
+		return m.Handler(next)
+	}
+}
+
+// activeSession tracks a session that is being served by Handler.
+type activeSession struct {
+	// invalidated is set by Invalidate to suppress saving the session.
+	invalidated atomic.Bool
+	// refs counts the requests sharing the session with AllowConcurrent.
+	// Once it drops to zero, the activeSession is removed and not reused.
+	refs atomic.Int32
+}
+
+// acquireActive registers a request for the session id.
+// It reports false if another request is serving the session
+// and m.AllowConcurrent is false.
+func (m *SessionStore[T]) acquireActive(id string) (*activeSession, bool) {
+	active := new(activeSession)
+	active.refs.Store(1)
+	for {
+		v, loaded := m.active.LoadOrStore(id, active)
+		if !loaded {
+			return active, true
+		}
+		if !m.AllowConcurrent {
+			return nil, false
+		}
+		if a := v.(*activeSession); a.acquire() {
+			return a, true
+		}
+		// a is being removed by its last request; try again.
+	}
+}
+
+func (m *SessionStore[T]) releaseActive(id string, a *activeSession) {
+	if a.refs.Add(-1) == 0 {
+		m.active.CompareAndDelete(id, a)
+	}
+}
+
+func (a *activeSession) acquire() bool {
+	for {
+		n := a.refs.Load()
+		if n == 0 {
+			return false
+		}
+		if a.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
 type sessionSaver[T any] struct {
 	http.ResponseWriter
 	req *http.Request
@@ -178,60 +753,145 @@ func (w *sessionSaver[T]) Write(b []byte) (int, error) {
 	if w.failed {
 		return 0, errors.New("httpsession: (ResponseWriter).Write was called after a call to ErrorHandler")
 	}
-	if !w.done {
-		if err := w.mw.save(w.req.Context(), w.ResponseWriter); err != nil {
-			w.mw.ErrorHandler(w.ResponseWriter, w.req, err)
-			w.failed = true
-			return 0, err
-		}
-		w.done = true
+	if err := w.saveOnce(); err != nil {
+		return 0, err
 	}
 	return w.ResponseWriter.Write(b)
 }
 
 func (w *sessionSaver[T]) WriteHeader(code int) {
 	if w.failed {
-		slog.Error("httpsession: (ResponseWriter).WriteHeader was called after a call to ErrorHandler")
+		w.mw.logger().ErrorContext(w.req.Context(), "httpsession: (ResponseWriter).WriteHeader was called after a call to ErrorHandler")
 		return
 	}
-	if !w.done {
-		if err := w.mw.save(w.req.Context(), w.ResponseWriter); err != nil {
-			w.mw.ErrorHandler(w.ResponseWriter, w.req, err)
-			w.failed = true
-			return
-		}
-		w.done = true
+	if err := w.saveOnce(); err != nil {
+		return
 	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Flush saves the session before flushing the response,
+// so that the Set-Cookie header is sent with the flushed headers.
+func (w *sessionSaver[T]) Flush() {
+	_ = w.FlushError()
+}
+
+// FlushError is like Flush but returns an error.
+// It is used by [http.ResponseController].
+func (w *sessionSaver[T]) FlushError() error {
+	if w.failed {
+		return errors.New("httpsession: (ResponseWriter).Flush was called after a call to ErrorHandler")
+	}
+	if err := w.saveOnce(); err != nil {
+		return err
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack saves the session before hijacking the connection.
+// The Set-Cookie header is added to w.Header(), so a handler that writes
+// its own response on the hijacked connection (e.g. a WebSocket handshake)
+// can include it.
+func (w *sessionSaver[T]) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.failed {
+		return nil, nil, errors.New("httpsession: (ResponseWriter).Hijack was called after a call to ErrorHandler")
+	}
+	if err := w.saveOnce(); err != nil {
+		return nil, nil, err
+	}
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// saveOnce saves the session if it has not been saved yet.
+// On failure, it calls ErrorHandler and marks w as failed.
+func (w *sessionSaver[T]) saveOnce() error {
+	if w.done {
+		return nil
+	}
+	if err := w.mw.save(w.ResponseWriter, w.req); err != nil {
+		w.mw.ErrorHandler(w.ResponseWriter, w.req, err)
+		w.failed = true
+		return err
+	}
+	w.done = true
+	return nil
+}
+
 func (w *sessionSaver[T]) Unwrap() http.ResponseWriter {
 	return w.ResponseWriter
 }
 
-func (m *SessionStore[T]) ensureSave(ctx context.Context) error {
+func (m *SessionStore[T]) ensureSave(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	record := m.recordFromContext(ctx)
-	if record.deleted() || record.readOnly() {
+	if record.bits&recordReadOnlyRequest != 0 || record.deleted() || record.invalidated() || !m.shouldSave(record) {
+		return nil
+	}
+	if !m.SaveWithoutCookie && !m.shouldSetCookie(r) {
 		return nil
 	}
-	return m.saveRecord(ctx, record)
+	if err := m.saveRecord(ctx, record); err != nil {
+		m.onSaveError(ctx, record, err)
+		return err
+	}
+	m.afterSave(w, r, record)
+	return nil
+}
+
+func (m *SessionStore[T]) afterSave(w http.ResponseWriter, r *http.Request, record *Record[T]) {
+	if m.AfterSave != nil {
+		m.AfterSave(w, r, record)
+	}
 }
 
-func (m *SessionStore[T]) save(ctx context.Context, w http.ResponseWriter) error {
+func (m *SessionStore[T]) onSaveError(ctx context.Context, record *Record[T], err error) {
+	if m.OnSaveError != nil {
+		m.OnSaveError(ctx, record.ID, err)
+	}
+}
+
+func (m *SessionStore[T]) save(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	record := m.recordFromContext(ctx)
-	if record.deleted() {
-		m.deleteCookie(w)
-	} else if record.readOnly() {
+	if m.shouldRotate(r, record) {
+		if err := m.renewID(ctx, record, "", false); err != nil {
+			return err
+		}
+	}
+	if record.bits&recordReadOnlyRequest != 0 {
+		// no-op
+	} else if record.deleted() || record.invalidated() {
+		m.deleteCookie(w, r)
+	} else if !m.shouldSave(record) {
+		// no-op
+	} else if setCookie := m.shouldSetCookie(r); !setCookie && !m.SaveWithoutCookie {
 		// no-op
 	} else {
 		if err := m.saveRecord(ctx, record); err != nil {
+			m.onSaveError(ctx, record, err)
 			return err
 		}
-		m.setCookie(w, record)
+		if setCookie && (!m.CookieOnlyOnChange || record.cookieChanged()) {
+			m.setCookie(w, r, record)
+		}
+		m.afterSave(w, r, record)
 	}
 	return nil
 }
 
+// shouldRotate reports whether the ID of record should be renewed
+// because of RotateEveryRequest before it is saved.
+func (m *SessionStore[T]) shouldRotate(r *http.Request, record *Record[T]) bool {
+	if !m.RotateEveryRequest || record.bits&(recordReadOnlyRequest|recordNew|recordRenewed|recordDeleted) != 0 {
+		return false
+	}
+	return !record.invalidated() && m.shouldSetCookie(r)
+}
+
+func (m *SessionStore[T]) shouldSetCookie(r *http.Request) bool {
+	return m.ShouldSetCookie == nil || m.ShouldSetCookie(r)
+}
+
 type recordContextKey[T any] struct{}
 
 func (m *SessionStore[T]) newContextWithRecord(ctx context.Context, r *Record[T]) context.Context {
@@ -246,31 +906,295 @@ func (m *SessionStore[T]) recordFromContext(ctx context.Context) *Record[T] {
 	return r
 }
 
-func (m *SessionStore[T]) setCookie(w http.ResponseWriter, r *Record[T]) {
-	cookie := m.SetCookie
-	cookie.Value = r.ID
-	cookie.MaxAge = int(r.IdleDeadline.Sub(m.now()).Seconds())
+func (m *SessionStore[T]) setCookie(w http.ResponseWriter, req *http.Request, r *Record[T]) {
+	value := m.signID(strings.TrimPrefix(r.ID, r.keyPrefix))
+	deadline := r.IdleDeadline
+	if m.CookieOnlyOnChange {
+		deadline = r.AbsoluteDeadline
+	}
+	if m.Transport != nil {
+		m.Transport.Inject(w, value, deadline)
+		return
+	}
+	cookie := m.cookie(req)
+	if r.sameSite != 0 {
+		cookie.SameSite = r.sameSite
+	}
+	cookie.Value = value
+	cookie.MaxAge = int(deadline.Sub(m.now()).Seconds())
 	http.SetCookie(w, &cookie)
 }
 
-func (m *SessionStore[T]) deleteCookie(w http.ResponseWriter) {
+// cookie returns m.SetCookie with the Secure attribute for req.
+func (m *SessionStore[T]) cookie(req *http.Request) http.Cookie {
 	cookie := m.SetCookie
+	if m.AutoSecure && !strings.HasPrefix(cookie.Name, HostPrefix) && !strings.HasPrefix(cookie.Name, SecurePrefix) {
+		cookie.Secure = m.isSecure(req)
+	}
+	return cookie
+}
+
+// ClearCookies expires the session cookie, or clears the token with
+// Transport if set. Delete does the same for the current session;
+// ClearCookies is for handlers outside the middleware, e.g. a logout
+// endpoint that must also remove the cookie of an unknown session.
+func (m *SessionStore[T]) ClearCookies(w http.ResponseWriter, r *http.Request) {
+	m.deleteCookie(w, r)
+}
+
+// loadRecord loads the record of key into record.
+// It reports false if the record is not found or has expired.
+func (m *SessionStore[T]) loadRecord(ctx context.Context, key string, record *Record[T]) (bool, error) {
+	found, err := m.Store.Load(ctx, key, record)
+	if errors.Is(err, ErrRecordNotFound) {
+		found, err = false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// Load may have copied a whole Record including its unexported fields,
+	// which only apply to the request that set them.
+	record.bits = 0
+	record.active = nil
+	record.sameSite = 0
+	if found && record.ID != key {
+		// loaded through an alias; send the new ID.
+		record.setBit(recordCookieChanged, true)
+	}
+	if now := m.now(); found && (record.IdleDeadline.Before(now) || record.AbsoluteDeadline.Before(now)) {
+		found = false
+	}
+	return found, nil
+}
+
+// idsFromRequest returns the candidate session IDs in the cookies of r,
+// or in the token extracted by Transport if set, in the order they were sent.
+// There may be more than one candidate if the client sent several cookies
+// of the same name, e.g. a stale one for another path.
+// Values that are not valid IDs, e.g. because of an invalid signature
+// with SignKey, are skipped.
+func (m *SessionStore[T]) idsFromRequest(r *http.Request) []string {
+	var values []string
+	if m.Transport != nil {
+		if token, ok := m.Transport.Extract(r); ok {
+			values = []string{token}
+		}
+	} else {
+		for _, c := range r.CookiesNamed(m.SetCookie.Name) {
+			values = append(values, c.Value)
+		}
+	}
+	ids := values[:0]
+	for _, v := range values {
+		if id, ok := m.parseID(v); ok && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// parseID returns the session ID in value.
+// If SignKey is set, it returns false if the signature is invalid.
+func (m *SessionStore[T]) parseID(value string) (string, bool) {
+	if m.MaxIDLength > 0 && len(value) > m.MaxIDLength {
+		return "", false
+	}
+	id := value
+	if m.SignKey != nil {
+		i := strings.LastIndexByte(value, '.')
+		if i < 0 {
+			return "", false
+		}
+		var sig string
+		id, sig = value[:i], value[i+1:]
+		mac, err := base64.RawURLEncoding.DecodeString(sig)
+		if err != nil || !hmac.Equal(mac, m.mac(id)) {
+			return "", false
+		}
+	}
+	if !m.validID(id) {
+		return "", false
+	}
+	return id, true
+}
+
+// validID reports whether id is accepted by IDValidator.
+func (m *SessionStore[T]) validID(id string) bool {
+	return m.IDValidator == nil || m.IDValidator(id)
+}
+
+// ClientIP returns the IP address of the client that sent r.
+// If "X-Forwarded-For" is in TrustedProxyHeaders, the last address in it is used,
+// i.e. the one appended by the trusted proxy.
+// Otherwise, if "X-Real-Ip" is in TrustedProxyHeaders, it is used.
+// It falls back to the host of r.RemoteAddr if no trusted header holds a valid address.
+func (m *SessionStore[T]) ClientIP(r *http.Request) string {
+	if m.trusts("X-Forwarded-For") {
+		if v := lastHeaderValue(r, "X-Forwarded-For"); v != "" {
+			if addr, err := netip.ParseAddr(v); err == nil {
+				return addr.String()
+			}
+		}
+	}
+	if m.trusts("X-Real-Ip") {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-Ip"))); err == nil {
+			return addr.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isSecure reports whether r was sent over HTTPS by the client.
+// "X-Forwarded-Proto" is honored only if it is in TrustedProxyHeaders.
+func (m *SessionStore[T]) isSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return m.trusts("X-Forwarded-Proto") && strings.EqualFold(lastHeaderValue(r, "X-Forwarded-Proto"), "https")
+}
+
+func (m *SessionStore[T]) trusts(header string) bool {
+	for _, h := range m.TrustedProxyHeaders {
+		if http.CanonicalHeaderKey(h) == header {
+			return true
+		}
+	}
+	return false
+}
+
+// lastHeaderValue returns the last element of the comma-separated list
+// in the header values of r.
+func lastHeaderValue(r *http.Request, header string) string {
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return ""
+	}
+	v := values[len(values)-1]
+	if i := strings.LastIndexByte(v, ','); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+// signID returns id followed by its signature if SignKey is set.
+func (m *SessionStore[T]) signID(id string) string {
+	if m.SignKey == nil {
+		return id
+	}
+	return id + "." + base64.RawURLEncoding.EncodeToString(m.mac(id))
+}
+
+func (m *SessionStore[T]) mac(id string) []byte {
+	h := hmac.New(sha256.New, m.SignKey)
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
+
+func (m *SessionStore[T]) deleteCookie(w http.ResponseWriter, req *http.Request) {
+	if m.Transport != nil {
+		m.Transport.Clear(w)
+		return
+	}
+	cookie := m.cookie(req)
 	cookie.MaxAge = -1
 	http.SetCookie(w, &cookie)
 }
 
+func (m *SessionStore[T]) shouldSave(r *Record[T]) bool {
+	if !r.readOnly() || r.touched() {
+		return true
+	}
+	if m.IdleDeadlinePrecision <= 0 || r.IdleDeadline.IsZero() {
+		return false
+	}
+	return m.nextIdleDeadline(r).Sub(r.IdleDeadline) >= m.IdleDeadlinePrecision
+}
+
+func (m *SessionStore[T]) nextIdleDeadline(r *Record[T]) time.Time {
+	now, timeout := m.now(), m.idleTimeout()
+	deadline := now.Add(timeout)
+	if !m.SlideIdleDeadline && !r.IdleDeadline.IsZero() && r.IdleDeadline.Sub(now) >= timeout/2 {
+		deadline = r.IdleDeadline
+	}
+	if r.AbsoluteDeadline.Before(deadline) {
+		deadline = r.AbsoluteDeadline
+	}
+	return deadline
+}
+
 // If session was deleted, it returns record (session == nil) and nil.
 func (m *SessionStore[T]) saveRecord(ctx context.Context, r *Record[T]) error {
-	r.IdleDeadline = m.now().Add(m.IdleTimeout)
-	if r.AbsoluteDeadline.Before(r.IdleDeadline) {
-		r.IdleDeadline = r.AbsoluteDeadline
+	loaded := !r.IdleDeadline.IsZero()
+	r.IdleDeadline = m.nextIdleDeadline(r)
+	if t, ok := m.Store.(Toucher); ok && loaded && r.readOnly() {
+		if err := t.Touch(ctx, r.ID, r.IdleDeadline); err != nil {
+			return err
+		}
+	} else if err := m.Store.Save(ctx, r); err != nil {
+		return err
+	}
+	if r.invalidated() {
+		// Invalidate was called while saving; make sure that the record
+		// is not resurrected.
+		return m.Store.Delete(ctx, r.ID)
+	}
+	return nil
+}
+
+// NewTestContext returns a copy of ctx that carries a session holding sess,
+// as Handler does for a session loaded from Store, and the record of the
+// session. It lets tests of handlers that use m, such as by Get or Read,
+// run without Handler and Store; the returned record reflects what
+// the handler did to the session.
+// Delete, Renew and RenewID still call m.Store.
+func (m *SessionStore[T]) NewTestContext(ctx context.Context, sess T) (context.Context, *Record[T]) {
+	now := m.now()
+	r := &Record[T]{
+		ID:               m.IDGenerator(),
+		IdleDeadline:     now.Add(m.idleTimeout()),
+		AbsoluteDeadline: m.absoluteDeadline(),
+		Session:          sess,
+	}
+	return m.newContextWithRecord(ctx, r), r
+}
+
+// Populate saves sessions with the given IDs to m.Store, e.g. to seed a store
+// with known session cookies in integration tests, or to migrate sessions
+// from another system. Each session gets fresh idle and absolute deadlines.
+// IDs are checked as those passed to RenewID and are used as cookie values
+// as they are; if Namespace is used, they must include the namespace.
+// Populate stops at the first error.
+func (m *SessionStore[T]) Populate(ctx context.Context, pairs ...struct {
+	ID      string
+	Session T
+}) error {
+	for _, p := range pairs {
+		// Skip the namespace, if any.
+		if !m.validID(p.ID[strings.LastIndexByte(p.ID, ':')+1:]) {
+			return fmt.Errorf("httpsession: invalid session ID %q", p.ID)
+		}
+		r := &Record[T]{
+			ID:               p.ID,
+			AbsoluteDeadline: m.absoluteDeadline(),
+			Session:          p.Session,
+		}
+		r.IdleDeadline = m.nextIdleDeadline(r)
+		if err := m.Store.Save(ctx, r); err != nil {
+			return err
+		}
 	}
-	return m.Store.Save(ctx, r)
+	return nil
 }
 
 func (m *SessionStore[T]) getRecord() *Record[T] {
 	r := m.recordPool.Get().(*Record[T])
-	r.bits = 0
+	// Reset all fields so that nothing leaks from a previous request,
+	// even one whose handler panicked.
+	*r = Record[T]{}
 	return r
 }
 
@@ -280,6 +1204,7 @@ func (m *SessionStore[T]) putRecord(r *Record[T]) {
 
 func (m *SessionStore[T]) Get(ctx context.Context) *T {
 	r := m.recordFromContext(ctx)
+	r.mustWritable()
 	if r.deleted() {
 		panic("httpsession: session alreadly deleted")
 	}
@@ -295,58 +1220,317 @@ func (m *SessionStore[T]) Read(ctx context.Context) *T {
 	return &r.Session
 }
 
+// Touch extends the idle deadline of the current session without modifying it.
+// If m.Store implements [Toucher], the session is not rewritten.
+func (m *SessionStore[T]) Touch(ctx context.Context) {
+	r := m.recordFromContext(ctx)
+	r.mustWritable()
+	r.setBit(recordTouched, true)
+}
+
+// ExtendAbsolute pushes the absolute deadline of the current session forward by d,
+// but never beyond now+max, e.g. to keep a user logged in during a long task.
+// Unlike Renew, the session ID is kept and the deadline is not reset
+// to the full AbsoluteTimeout. The deadline is never moved backward.
+// It returns an error if d or max is negative.
+func (m *SessionStore[T]) ExtendAbsolute(ctx context.Context, d, max time.Duration) error {
+	if d < 0 || max < 0 {
+		return fmt.Errorf("httpsession: negative extension %v or cap %v", d, max)
+	}
+	r := m.recordFromContext(ctx)
+	r.mustWritable()
+	if r.deleted() {
+		panic("httpsession: session alreadly deleted")
+	}
+	deadline := r.AbsoluteDeadline.Add(d)
+	if limit := m.now().Add(max); deadline.After(limit) {
+		deadline = limit
+	}
+	if deadline.After(r.AbsoluteDeadline) {
+		r.AbsoluteDeadline = deadline
+		r.setBit(recordModified, true)
+		r.setBit(recordCookieChanged, true)
+	}
+	return nil
+}
+
+// SetAbsoluteDeadline sets the absolute deadline of the current session to t,
+// overriding AbsoluteTimeout, e.g. to give a "remember me" login a longer
+// lifetime. The idle deadline is never set beyond t.
+// Renew and RenewID reset the deadline, so call it after them,
+// e.g. after OnAuthenticated.
+func (m *SessionStore[T]) SetAbsoluteDeadline(ctx context.Context, t time.Time) {
+	r := m.recordFromContext(ctx)
+	r.mustWritable()
+	if r.deleted() {
+		panic("httpsession: session alreadly deleted")
+	}
+	r.AbsoluteDeadline = t
+	r.setBit(recordModified, true)
+	r.setBit(recordCookieChanged, true)
+}
+
+// Flash adds a one-time message to the current session.
+// Messages are kept until they are read by ReadFlash, even across requests,
+// e.g. to show a message after a redirect.
+func (m *SessionStore[T]) Flash(ctx context.Context, msg string) {
+	r := m.recordFromContext(ctx)
+	r.mustWritable()
+	if r.deleted() {
+		panic("httpsession: session alreadly deleted")
+	}
+	r.Flashes = append(r.Flashes, msg)
+	r.setBit(recordModified, true)
+}
+
+// ReadFlash removes and returns the oldest message added by Flash.
+// If there is no message, it returns "" and false.
+func (m *SessionStore[T]) ReadFlash(ctx context.Context) (msg string, ok bool) {
+	r := m.recordFromContext(ctx)
+	r.mustWritable()
+	if len(r.Flashes) == 0 {
+		return "", false
+	}
+	msg = r.Flashes[0]
+	r.Flashes = r.Flashes[1:]
+	r.setBit(recordModified, true)
+	return msg, true
+}
+
+// IsNew reports whether the current session was created in this request
+// because no valid session cookie was found, rather than loaded from m.Store.
+func (m *SessionStore[T]) IsNew(ctx context.Context) bool {
+	r := m.recordFromContext(ctx)
+	return r.isNew()
+}
+
+// SessionInfo is a snapshot of the metadata of a session returned by [SessionStore.Info].
+type SessionInfo struct {
+	ID    string
+	IsNew bool
+	// IdleDeadline is the idle deadline loaded from the store,
+	// which is zero for a new session. It is extended when the session is saved.
+	IdleDeadline     time.Time
+	AbsoluteDeadline time.Time
+}
+
+// Info returns the metadata of the current session,
+// e.g. to render an account or security page.
+func (m *SessionStore[T]) Info(ctx context.Context) SessionInfo {
+	r := m.recordFromContext(ctx)
+	return SessionInfo{
+		ID:               r.ID,
+		IsNew:            r.isNew(),
+		IdleDeadline:     r.IdleDeadline,
+		AbsoluteDeadline: r.AbsoluteDeadline,
+	}
+}
+
+// Deadlines returns the idle and absolute deadlines of the current session,
+// as in [SessionStore.Info], without marking the session modified.
+func (m *SessionStore[T]) Deadlines(ctx context.Context) (idle, absolute time.Time) {
+	r := m.recordFromContext(ctx)
+	return r.IdleDeadline, r.AbsoluteDeadline
+}
+
 func (m *SessionStore[T]) ID(ctx context.Context) string {
 	r := m.recordFromContext(ctx)
 	return r.ID
 }
 
+// SetCookieSameSite overrides the SameSite attribute of m.SetCookie
+// for the cookie set in the current response.
+//
+// Note that browsers keep the attribute until the cookie is set again, so a
+// weaker mode affects subsequent requests as well.
+// Relaxing SameSite makes the session cookie be sent with cross-site requests,
+// which removes a layer of CSRF protection. Use it only for routes that need it
+// and consider renewing the cookie with the default mode afterwards.
+// [http.SameSiteNoneMode] also requires the Secure attribute.
+func (m *SessionStore[T]) SetCookieSameSite(ctx context.Context, mode http.SameSite) {
+	r := m.recordFromContext(ctx)
+	r.mustWritable()
+	r.sameSite = mode
+	r.setBit(recordCookieChanged, true)
+}
+
+// Delete deletes the current session from m.Store and expires its cookie.
+// A new session that has not been saved yet is not in m.Store,
+// so m.Store.Delete is not called for it.
 func (m *SessionStore[T]) Delete(ctx context.Context) error {
 	r := m.recordFromContext(ctx)
+	r.mustWritable()
 	r.setBit(recordDeleted, true)
-	if err := m.Store.Delete(ctx, r.ID); err != nil {
-		return err
+	// A new record has a zero IdleDeadline until saveRecord sets it.
+	if !r.isNew() || !r.IdleDeadline.IsZero() {
+		if err := m.Store.Delete(ctx, r.ID); err != nil {
+			return err
+		}
 	}
 	r.setBit(recordModified, true)
+	if m.OnDelete != nil {
+		m.OnDelete(ctx, r.ID)
+	}
 	return nil
 }
 
+// Invalidate deletes a session record associated with id from m.Store.
+// Unlike calling m.Store.Delete directly, it also prevents a request that is
+// currently using the session from saving it again.
+// If Namespace is set, id must include the namespace, as in [Record.ID].
+func (m *SessionStore[T]) Invalidate(ctx context.Context, id string) error {
+	if v, ok := m.active.Load(id); ok {
+		v.(*activeSession).invalidated.Store(true)
+	}
+	return m.Store.Delete(ctx, id)
+}
+
 func (m *SessionStore[T]) Renew(ctx context.Context) error {
 	return m.RenewID(ctx, "")
 }
 
 // It is caller's responsibility to choose a unique id.
+// The old ID is deleted, or kept as an alias during RenewGracePeriod.
+// If Namespace is set, the namespace of the current session is prepended to id.
+//
+// RenewID returns an error if id is not accepted by IDValidator.
+// This is a breaking change: the default IDValidator accepts only
+// [DefaultIDAlphabet], so IDs such as "user:123" that RenewID used to accept
+// are now rejected. To keep using them, set IDValidator to a function that
+// accepts them; it also checks the IDs sent by clients.
 func (m *SessionStore[T]) RenewID(ctx context.Context, id string) error {
 	r := m.recordFromContext(ctx)
-	err := m.Store.Delete(ctx, r.ID)
+	r.mustWritable()
+	return m.renewID(ctx, r, id, true)
+}
+
+// renewID changes the ID of r to id, or a new ID if id is empty.
+// If resetDeadline is true, the absolute deadline is reset as for a new session.
+func (m *SessionStore[T]) renewID(ctx context.Context, r *Record[T], id string, resetDeadline bool) error {
+	if id == "" {
+		id = m.IDGenerator()
+	}
+	if !m.validID(id) {
+		return fmt.Errorf("httpsession: invalid session ID %q", id)
+	}
+	newID := r.keyPrefix + id
+
+	var err error
+	if a, ok := m.Store.(Aliaser); ok && m.RenewGracePeriod > 0 {
+		err = a.Alias(ctx, r.ID, newID, m.now().Add(m.RenewGracePeriod))
+	} else {
+		err = m.Store.Delete(ctx, r.ID)
+	}
 	if err != nil {
 		r.setBit(recordDeleted, true)
 		return err
 	}
 
-	if id == "" {
-		id = rand.Text()
+	oldID := r.ID
+	r.ID = newID
+	if resetDeadline {
+		r.AbsoluteDeadline = m.absoluteDeadline()
 	}
-	r.ID = id
-	r.AbsoluteDeadline = m.now().Add(m.AbsoluteTimeout)
 	r.setBit(recordModified, true)
+	r.setBit(recordCookieChanged, true)
+	r.setBit(recordRenewed, true)
+	if m.OnRenew != nil {
+		m.OnRenew(ctx, oldID, r.ID)
+	}
 	return nil
 }
 
-func (m *SessionStore[T]) Cleanup(ctx context.Context, interval time.Duration) {
-	cleanup := func() {
-		c := time.Tick(interval)
+// OnAuthenticated renews the session ID of the current session while keeping
+// its data, as the ID must change whenever the privilege level of a session
+// changes. Call it from a login handler after the credentials are verified
+// and before writing the response:
+//
+//	if err := session.OnAuthenticated(r.Context()); err != nil {
+//		http.Error(w, "internal server error", http.StatusInternalServerError)
+//		return
+//	}
+//	session.Get(r.Context()).UserID = user.ID
+//
+// A session ID fixed by an attacker before login is thus useless afterwards.
+func (m *SessionStore[T]) OnAuthenticated(ctx context.Context) error {
+	return m.Renew(ctx)
+}
+
+// Cleanup starts a goroutine that deletes expired sessions from m.Store
+// every interval until ctx is done or stop is called.
+// stop waits for the goroutine to return, and it may be called more than once.
+// Cleanup panics if interval is not positive.
+func (m *SessionStore[T]) Cleanup(ctx context.Context, interval time.Duration) (stop func()) {
+	return m.CleanupWithJitter(ctx, interval, 0)
+}
+
+// CleanupWithJitter is like Cleanup, but each wait between deletions is
+// chosen randomly from [interval-jitter, interval+jitter], so that replicas
+// sharing a store do not all call DeleteExpired at the same time.
+// A jitter of zero behaves exactly like Cleanup.
+// jitter is capped at interval/2.
+func (m *SessionStore[T]) CleanupWithJitter(ctx context.Context, interval, jitter time.Duration) (stop func()) {
+	if interval <= 0 {
+		// Panic here rather than in time.NewTicker in the goroutine,
+		// which would crash the program without a useful stack.
+		panic("httpsession: non-positive interval for Cleanup")
+	}
+	jitter = min(jitter, interval/2)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(jittered(interval, jitter))
+		defer t.Stop()
 		for {
 			select {
-			case <-c:
-				if err := m.Store.DeleteExpired(ctx); err != nil {
-					slog.ErrorContext(ctx, "httpsession.DeleteExpiredInterval: "+err.Error())
+			case <-t.C:
+				if err := m.deleteExpired(ctx); err != nil && ctx.Err() == nil {
+					m.logger().ErrorContext(ctx, "httpsession.Cleanup: "+err.Error())
+				}
+				if jitter > 0 {
+					t.Reset(jittered(interval, jitter))
 				}
 			case <-ctx.Done():
 				return
 			}
 		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (m *SessionStore[T]) deleteExpired(ctx context.Context) error {
+	b, ok := m.Store.(BatchDeleter)
+	if !ok {
+		return m.Store.DeleteExpired(ctx)
+	}
+	limit := m.CleanupBatchSize
+	if limit <= 0 {
+		limit = 1000
+	}
+	for {
+		n, err := b.DeleteExpiredBatch(ctx, limit)
+		if err != nil {
+			return err
+		}
+		if n < limit {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// jittered returns a random duration in [d-jitter, d+jitter].
+func jittered(d, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return d
 	}
-	go cleanup()
+	return d - jitter + mathrand.N(2*jitter+1)
 }
 
 // func (m *Middleware[T]) DeleteExpiredInterval(ctx context.Context, interval time.Duration, errorHandler func(error)) {
@@ -371,31 +1555,6 @@ func (m *SessionStore[T]) Cleanup(ctx context.Context, interval time.Duration) {
 // 	go cleanup()
 // }
 
-// func (m *Middleware[T]) Populate(idSessionPairs ...any) {
-// 	if l := len(idSessionPairs); l <= 0 || l%2 != 0 {
-// 		panic("Populate: args must have non-zero even length")
-// 	}
-// 	argPos := 1
-// 	for pair := range slices.Chunk(idSessionPairs, 2) {
-// 		id, ok := pair[0].(string)
-// 		if !ok {
-// 			panic(fmt.Sprintf("Populate: arg %v expected string but got %T", argPos, pair[0]))
-// 		}
-// 		// session, ok := pair[1].(*T)
-// 		if !ok {
-// 			panic(fmt.Sprintf("Populate: arg %v expected %T but got %T", argPos+1, new(T), pair[1]))
-// 		}
-// 		record := m.newRecord()
-// 		record.ID = id
-// 		// record.session = session
-// 		ctx := m.newContextWithRecord(context.Background(), record)
-// 		if _, err := m.saveRecord(ctx); err != nil {
-// 			panic("Populate: " + err.Error())
-// 		}
-// 		argPos += 2
-// 	}
-// }
-
 // func (m *SessionStore[T]) saveSession(ctx context.Context, w http.ResponseWriter, record *Record[T]) error {
 // 	// r, err := m.saveRecord(ctx)
 // 	// if err != nil {
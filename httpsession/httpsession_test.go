@@ -1,12 +1,22 @@
 package httpsession
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"testing/synctest"
 	"time"
@@ -18,6 +28,8 @@ type rwUnwrapper interface {
 }
 
 var _ rwUnwrapper = (*sessionSaver[testSession])(nil)
+var _ http.Flusher = (*sessionSaver[testSession])(nil)
+var _ http.Hijacker = (*sessionSaver[testSession])(nil)
 
 func wantPanic(t *testing.T, wantRecover any) {
 	t.Helper()
@@ -337,196 +349,2377 @@ func TestRenewDelete(t *testing.T) {
 	}
 }
 
-func TestID(t *testing.T) {
-	ctx := t.Context()
+func TestOnAuthenticated(t *testing.T) {
+	store := newMemoryStore[testSession]()
 	session := New[testSession]()
-	r := new(Record[testSession])
-	r.ID = "testid"
-	ctx = session.newContextWithRecord(ctx, r)
-	if got := session.ID(ctx); got != "testid" {
-		t.Errorf("got %v; want testid", got)
+	session.Store = store
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			if err := session.OnAuthenticated(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	oldCookie := w.Result().Cookies()[0]
+
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.AddCookie(oldCookie)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	newCookie := w.Result().Cookies()[0]
+	if newCookie.Value == oldCookie.Value {
+		t.Fatal("session ID not renewed")
+	}
+	if _, ok := store.m[oldCookie.Value]; ok {
+		t.Error("old session found")
+	}
+	if got := store.m[newCookie.Value].Session.N; got != 2 {
+		t.Errorf("got N = %v; want 2", got)
 	}
 }
 
-func TestMiddlewareRace(t *testing.T) {
-	synctest.Test(t, func(t *testing.T) {
-		var errhCalled bool
-		errh := func(w http.ResponseWriter, r *http.Request, err error) {
-			if err.Error() == "httpsession: active session alreadly exists" {
-				errhCalled = true
-			}
+func TestRotateEveryRequest(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	session := New[testSession]()
+	session.Store = store
+	session.RotateEveryRequest = true
+	now := time.Now()
+	session.now = func() time.Time { return now }
+	var isNew bool
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isNew = session.IsNew(r.Context())
+		if r.URL.Path != "/read" {
+			session.Get(r.Context()).N++
+		}
+		w.Write(nil)
+	}))
+	serve := func(target string, cookie *http.Cookie) *http.Cookie {
+		r := httptest.NewRequest("GET", target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
 		}
-		session := New[testSession]()
-		session.ErrorHandler = errh
-		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			session.Get(r.Context())
-			time.Sleep(1 * time.Millisecond)
-			w.Write(nil)
-		}))
-		req := httptest.NewRequest("GET", "/", nil)
 		w := httptest.NewRecorder()
-		h.ServeHTTP(w, req)
-		res := w.Result()
-		cookie := res.Cookies()[0]
-		req1 := httptest.NewRequest("GET", "/", nil)
-		req2 := httptest.NewRequest("GET", "/", nil)
-		req1.AddCookie(cookie)
-		req2.AddCookie(cookie)
-
-		w1 := httptest.NewRecorder()
-		w2 := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			return cookies[0]
+		}
+		return nil
+	}
 
-		go func() {
-			h.ServeHTTP(w1, req1)
-		}()
-		synctest.Wait()
-		if errhCalled {
-			t.Error("unexpected errorHandler call")
+	first := serve("/", nil)
+	absolute := store.m[first.Value].AbsoluteDeadline
+	now = now.Add(time.Minute)
+	cookie := first
+	for _, target := range []string{"/", "/read"} {
+		next := serve(target, cookie)
+		if next == nil || next.Value == cookie.Value {
+			t.Fatalf("%s: session ID not rotated", target)
 		}
-		go func() {
-			h.ServeHTTP(w2, req2)
-		}()
-		synctest.Wait()
-		if !errhCalled {
-			t.Error("errorHandler was not called")
+		if _, ok := store.m[cookie.Value]; ok {
+			t.Errorf("%s: old session found", target)
 		}
-		time.Sleep(1 * time.Millisecond)
-	})
+		record := store.m[next.Value]
+		if !record.AbsoluteDeadline.Equal(absolute) {
+			t.Errorf("%s: got absolute deadline %v; want %v", target, record.AbsoluteDeadline, absolute)
+		}
+		cookie = next
+	}
+	if got := store.m[cookie.Value].Session.N; got != 2 {
+		t.Errorf("got N = %v; want 2", got)
+	}
+
+	// The old cookie starts a new session.
+	serve("/", first)
+	if !isNew {
+		t.Error("old cookie loaded a session")
+	}
 }
 
-func TestResponseController(t *testing.T) {
+func TestRotateEveryRequestConcurrent(t *testing.T) {
+	store := newMemoryStore[testSession]()
 	session := New[testSession]()
+	session.Store = store
+	session.RotateEveryRequest = true
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		t.Errorf("ErrorHandler: %v", err)
+	}
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	var isNew bool
 	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rc := http.NewResponseController(w)
-		if err := rc.Flush(); err != nil {
-			t.Error(err)
+		session.Get(r.Context()).N++
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-unblock
+		} else {
+			isNew = session.IsNew(r.Context())
 		}
+		w.Write(nil)
 	}))
-	r := httptest.NewRequest("GET", "/", nil)
-	w := httptest.NewRecorder()
-	h.ServeHTTP(w, r)
-	if !w.Flushed {
-		t.Errorf("Flush was not called")
+	serve := func(target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
 	}
-}
+	cookie := serve("/", nil).Result().Cookies()[0]
 
-type mockStore[T any] struct {
-	LoadFunc          func(context.Context, string, *Record[T]) (bool, error)
-	SaveFunc          func(context.Context, *Record[T]) error
-	DeleteFunc        func(context.Context, string) error
-	DeleteExpiredFunc func(context.Context) error
-}
+	// A second tab sends the same cookie while the first one is rotating it.
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve("/slow", cookie) }()
+	<-entered
+	w := serve("/", cookie)
+	close(unblock)
+	slow := <-done
 
-func (s *mockStore[T]) Load(ctx context.Context, id string, ret *Record[T]) (found bool, err error) {
-	if s.LoadFunc != nil {
-		return s.LoadFunc(ctx, id, ret)
+	if w.Code != http.StatusOK || slow.Code != http.StatusOK {
+		t.Fatalf("got status %v and %v; want %v", w.Code, slow.Code, http.StatusOK)
+	}
+	if !isNew {
+		t.Error("concurrent request did not start a new session")
+	}
+	fresh, rotated := w.Result().Cookies()[0], slow.Result().Cookies()[0]
+	if fresh.Value == cookie.Value || rotated.Value == cookie.Value || fresh.Value == rotated.Value {
+		t.Errorf("got cookies %q and %q from %q; want distinct IDs", fresh.Value, rotated.Value, cookie.Value)
+	}
+	if got := store.m[rotated.Value].Session.N; got != 2 {
+		t.Errorf("rotated session: got N = %v; want 2", got)
+	}
+	if got := store.m[fresh.Value].Session.N; got != 1 {
+		t.Errorf("new session: got N = %v; want 1", got)
 	}
-	return false, errors.ErrUnsupported
 }
 
-func (s *mockStore[T]) Save(ctx context.Context, r *Record[T]) error {
-	if s.SaveFunc != nil {
-		return s.SaveFunc(ctx, r)
+func TestDeleteNewSession(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	var deletes []string
+	session := New[testSession]()
+	session.Store = &mockStore[testSession]{
+		LoadFunc: store.Load,
+		SaveFunc: store.Save,
+		DeleteFunc: func(ctx context.Context, id string) error {
+			deletes = append(deletes, id)
+			return store.Delete(ctx, id)
+		},
 	}
-	return errors.ErrUnsupported
-}
+	var deleteErr error
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		if r.URL.Path != "/delete" {
+			w.Write(nil) // saves the session
+		}
+		if r.URL.Path != "/" {
+			deleteErr = session.Delete(r.Context())
+		}
+	}))
 
-func (s *mockStore[T]) Delete(ctx context.Context, id string) error {
-	if s.DeleteFunc != nil {
-		return s.DeleteFunc(ctx, id)
+	// A session that was never saved is not deleted from the store.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/delete", nil))
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	if len(deletes) != 0 {
+		t.Errorf("got Store.Delete(%q) for a new session", deletes)
+	}
+	if len(store.m) != 0 {
+		t.Errorf("got %v records; want 0", len(store.m))
 	}
-	return errors.ErrUnsupported
-}
 
-func (s *mockStore[T]) DeleteExpired(ctx context.Context) error {
-	if s.DeleteExpiredFunc != nil {
-		return s.DeleteExpiredFunc(ctx)
+	// A new session saved earlier in the request is deleted.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/write-delete", nil))
+	if len(deletes) != 1 || len(store.m) != 0 {
+		t.Errorf("got deletes %q and %v records; want 1 delete and 0 records", deletes, len(store.m))
+	}
+
+	// A loaded session is deleted.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	r := httptest.NewRequest("GET", "/delete", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if len(deletes) != 2 || len(store.m) != 0 {
+		t.Errorf("got deletes %q and %v records; want 2 deletes and 0 records", deletes, len(store.m))
 	}
-	return errors.ErrUnsupported
 }
 
-func TestErrorHandler(t *testing.T) {
+func TestRenewGracePeriod(t *testing.T) {
+	store := newMemoryStore[testSession]()
 	session := New[testSession]()
-	session.Store = &mockStore[testSession]{}
-	var called bool
-	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		called = true
-	}
+	session.Store = store
+	session.RenewGracePeriod = time.Minute
+	session.CookieOnlyOnChange = true
 	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session.Get(r.Context())
+		if r.URL.Path == "/renew" {
+			if err := session.RenewID(r.Context(), "newid"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		session.Get(r.Context()).N++
 		w.Write(nil)
 	}))
-	r := httptest.NewRequest("GET", "/", nil)
 	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	oldCookie := w.Result().Cookies()[0]
+
+	r := httptest.NewRequest("GET", "/renew", nil)
+	r.AddCookie(oldCookie)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if _, ok := store.m[oldCookie.Value]; ok {
+		t.Fatal("old session found")
+	}
+
+	// A request with the old cookie right after renewal uses the new session.
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(oldCookie)
+	w = httptest.NewRecorder()
 	h.ServeHTTP(w, r)
-	if !called {
-		t.Error("ErrorHandler was not called")
+	if got := store.m["newid"].Session.N; got != 3 {
+		t.Errorf("got N = %v; want 3", got)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != "newid" {
+		t.Errorf("got cookies %v; want newid", cookies)
 	}
 }
 
-func TestDefaultErrorHandler(t *testing.T) {
+func TestID(t *testing.T) {
+	ctx := t.Context()
 	session := New[testSession]()
-	session.Store = &mockStore[testSession]{}
+	r := new(Record[testSession])
+	r.ID = "testid"
+	ctx = session.newContextWithRecord(ctx, r)
+	if got := session.ID(ctx); got != "testid" {
+		t.Errorf("got %v; want testid", got)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	session := New[testSession]()
+	now := time.Now()
+	session.now = func() time.Time { return now }
+	session.IDGenerator = func() string { return "testid" }
+	var infos []SessionInfo
 	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infos = append(infos, session.Info(r.Context()))
 		session.Get(r.Context())
-		w.WriteHeader(200)
+		w.Write(nil)
 	}))
-	r := httptest.NewRequest("GET", "/", nil)
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, r)
-	if w.Code != 500 {
-		t.Errorf("got %v; want 500", w.Code)
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	want := []SessionInfo{
+		{ID: "testid", IsNew: true, AbsoluteDeadline: now.Add(session.AbsoluteTimeout)},
+		{ID: "testid", IsNew: false, IdleDeadline: now.Add(session.IdleTimeout), AbsoluteDeadline: now.Add(session.AbsoluteTimeout)},
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("got %v infos; want %v", len(infos), len(want))
+	}
+	for i := range want {
+		got := infos[i]
+		if got.ID != want[i].ID || got.IsNew != want[i].IsNew ||
+			!got.IdleDeadline.Equal(want[i].IdleDeadline) || !got.AbsoluteDeadline.Equal(want[i].AbsoluteDeadline) {
+			t.Errorf("got %+v; want %+v", got, want[i])
+		}
 	}
 }
 
-func TestAbsoluteDeadline(t *testing.T) {
+func TestDeadlines(t *testing.T) {
+	store := newMemoryStore[testSession]()
 	session := New[testSession]()
+	session.Store = store
+	session.IdleDeadlinePrecision = time.Hour
 	now := time.Now()
 	session.now = func() time.Time { return now }
-	session.AbsoluteTimeout = 0
-	var record *Record[testSession]
-	session.Store = &mockStore[testSession]{
-		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
-			record = r
-			return nil
-		},
-	}
+	var idle, absolute time.Time
 	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session.Get(r.Context())
+		if r.URL.Path == "/get" {
+			session.Get(r.Context())
+		}
+		idle, absolute = session.Deadlines(r.Context())
 		w.Write(nil)
 	}))
-	r := httptest.NewRequest("GET", "/", nil)
 	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/get", nil))
+	cookie := w.Result().Cookies()[0]
+
+	now = now.Add(time.Minute)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
 	h.ServeHTTP(w, r)
-	if !record.IdleDeadline.Equal(now) {
-		t.Errorf("got %v; want %v", record.IdleDeadline, now)
+	record := store.m[cookie.Value]
+	if !idle.Equal(record.IdleDeadline) || !absolute.Equal(record.AbsoluteDeadline) {
+		t.Errorf("got %v, %v; want %v, %v", idle, absolute, record.IdleDeadline, record.AbsoluteDeadline)
+	}
+	// Deadlines does not make the session be saved.
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("got %v cookies; want 0", len(cookies))
 	}
 }
 
-func TestCleanup(t *testing.T) {
+func TestIDGenerator(t *testing.T) {
 	session := New[testSession]()
-	record := Record[testSession]{
-		ID: "testid",
+	var n int
+	session.IDGenerator = func() string {
+		n++
+		return "id" + strconv.Itoa(n)
 	}
-	if err := session.Store.Save(t.Context(), &record); err != nil {
-		t.Fatal(err)
+	var ids []string
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, session.ID(r.Context()))
+		if err := session.Renew(r.Context()); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, session.ID(r.Context()))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if want := []string{"id1", "id2"}; !slices.Equal(ids, want) {
+		t.Errorf("got %v; want %v", ids, want)
 	}
-	session.Cleanup(t.Context(), 500*time.Microsecond)
-	time.Sleep(1 * time.Millisecond)
-	if found, err := session.Store.Load(t.Context(), record.ID, &record); err != nil || found {
-		t.Fatalf("Load() = %v, %t", err, found)
+}
+
+func TestCookieOnlyOnChange(t *testing.T) {
+	session := New[testSession]()
+	session.CookieOnlyOnChange = true
+	now := time.Now()
+	session.now = func() time.Time { return now }
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		if r.RequestURI == "/renew" {
+			if err := session.Renew(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Write(nil)
+	}))
+
+	tests := []struct {
+		target     string
+		wantCookie bool
+	}{
+		{"/", true},
+		{"/", false},
+		{"/", false},
+		{"/renew", true},
+		{"/", false},
+	}
+	var cookie *http.Cookie
+	for _, tt := range tests {
+		now = now.Add(time.Minute)
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		cookies := w.Result().Cookies()
+		if got := len(cookies) == 1; got != tt.wantCookie {
+			t.Fatalf("%v: got cookie %v; want %v", tt.target, got, tt.wantCookie)
+		}
+		if tt.wantCookie {
+			cookie = cookies[0]
+			if want := int(session.AbsoluteTimeout.Seconds()); cookie.MaxAge != want {
+				t.Errorf("MaxAge = %v; want %v", cookie.MaxAge, want)
+			}
+		}
 	}
 }
 
-func TestCleanupNoLeak(t *testing.T) {
+func TestSignKey(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	var loads int
 	session := New[testSession]()
-	before := runtime.NumGoroutine()
-	ctx, cancel := context.WithCancel(t.Context())
-	session.Cleanup(ctx, 1*time.Second)
-	cancel()
-	time.Sleep(10 * time.Millisecond)
-	after := runtime.NumGoroutine()
-	if before != after {
-		t.Fatalf("%v => %v", before, after)
+	session.SignKey = []byte("secret")
+	session.Store = &mockStore[testSession]{
+		LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+			loads++
+			return store.Load(ctx, id, r)
+		},
+		SaveFunc: store.Save,
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookie := w.Result().Cookies()[0]
+	id, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		t.Fatalf("cookie value %q is not signed", cookie.Value)
+	}
+	if _, ok := store.m[id]; !ok {
+		t.Fatalf("session %q not found", id)
+	}
+
+	tests := []struct {
+		value     string
+		wantN     int
+		wantLoads int
+	}{
+		{cookie.Value, 2, 1},
+		{id, 1, 0},
+		{id + ".", 1, 0},
+		{id + "." + sig[:len(sig)-1], 1, 0},
+		{id + "." + strings.ToLower(sig), 1, 0},
+		{"x" + id[1:] + "." + sig, 1, 0},
+	}
+	for _, tt := range tests {
+		loads = 0
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: tt.value})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		newID, _, _ := strings.Cut(w.Result().Cookies()[0].Value, ".")
+		if got := store.m[newID].Session.N; got != tt.wantN {
+			t.Errorf("%q: got N = %v; want %v", tt.value, got, tt.wantN)
+		}
+		if loads != tt.wantLoads {
+			t.Errorf("%q: Load was called %v times; want %v", tt.value, loads, tt.wantLoads)
+		}
 	}
 }
+
+type countingStore[T any] struct {
+	*memoryStore[T]
+	saves, touches int
+}
+
+func (s *countingStore[T]) Save(ctx context.Context, r *Record[T]) error {
+	s.saves++
+	return s.memoryStore.Save(ctx, r)
+}
+
+func (s *countingStore[T]) Touch(ctx context.Context, id string, idleDeadline time.Time) error {
+	s.touches++
+	return s.memoryStore.Touch(ctx, id, idleDeadline)
+}
+
+func TestTouch(t *testing.T) {
+	store := &countingStore[testSession]{memoryStore: newMemoryStore[testSession]()}
+	session := New[testSession]()
+	session.Store = store
+	now := time.Now()
+	session.now = func() time.Time { return now }
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/get" {
+			session.Get(r.Context()).N++
+		} else {
+			session.Touch(r.Context())
+		}
+		w.Write(nil)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/touch", nil))
+	if store.saves != 1 || store.touches != 0 {
+		t.Fatalf("saves, touches = %v, %v; want 1, 0", store.saves, store.touches)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/get", nil))
+	cookie := w.Result().Cookies()[0]
+	if store.saves != 2 || store.touches != 0 {
+		t.Fatalf("saves, touches = %v, %v; want 2, 0", store.saves, store.touches)
+	}
+
+	now = now.Add(time.Hour)
+	r := httptest.NewRequest("GET", "/touch", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if store.saves != 2 || store.touches != 1 {
+		t.Fatalf("saves, touches = %v, %v; want 2, 1", store.saves, store.touches)
+	}
+	got := store.m[cookie.Value]
+	if want := now.Add(session.IdleTimeout); !got.IdleDeadline.Equal(want) {
+		t.Errorf("IdleDeadline = %v; want %v", got.IdleDeadline, want)
+	}
+	if got.Session.N != 1 {
+		t.Errorf("got %v; want 1", got.Session.N)
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Error("cookie was not set after Touch")
+	}
+}
+
+func TestSetCookieName(t *testing.T) {
+	tests := []struct {
+		prefix, name string
+		modify       func(c *http.Cookie)
+		want         string
+		wantErr      bool
+	}{
+		{prefix: "", name: "app", want: "app"},
+		{prefix: HostPrefix, name: "app", want: "__Host-app"},
+		{prefix: SecurePrefix, name: "app", want: "__Secure-app"},
+		{prefix: "__Foo-", name: "app", wantErr: true},
+		{prefix: HostPrefix, name: "a pp", wantErr: true},
+		{prefix: HostPrefix, name: "app", modify: func(c *http.Cookie) { c.Domain = "example.com" }, wantErr: true},
+		{prefix: HostPrefix, name: "app", modify: func(c *http.Cookie) { c.Path = "/app" }, wantErr: true},
+		{prefix: HostPrefix, name: "app", modify: func(c *http.Cookie) { c.Secure = false }, wantErr: true},
+		{prefix: SecurePrefix, name: "app", modify: func(c *http.Cookie) { c.Domain = "example.com" }, want: "__Secure-app"},
+		{prefix: SecurePrefix, name: "app", modify: func(c *http.Cookie) { c.Secure = false }, wantErr: true},
+	}
+	for _, tt := range tests {
+		session := New[testSession]()
+		if tt.modify != nil {
+			tt.modify(&session.SetCookie)
+		}
+		err := session.SetCookieName(tt.prefix, tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetCookieName(%q, %q) = %v; wantErr %v", tt.prefix, tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			if session.SetCookie.Name != DefaultCookieName {
+				t.Errorf("SetCookie.Name was modified to %q", session.SetCookie.Name)
+			}
+		} else if session.SetCookie.Name != tt.want {
+			t.Errorf("got %q; want %q", session.SetCookie.Name, tt.want)
+		}
+	}
+}
+
+func TestHandlerValidatesCookie(t *testing.T) {
+	tests := []struct {
+		modify    func(c *http.Cookie)
+		wantPanic bool
+	}{
+		{func(c *http.Cookie) { c.Name = "__Host-id" }, false},
+		{func(c *http.Cookie) { c.Name = "__Host-id"; c.Domain = "example.com" }, true},
+		{func(c *http.Cookie) { c.Name = "__Host-id"; c.Path = "/app" }, true},
+		{func(c *http.Cookie) { c.Name = "__Secure-id"; c.Secure = false }, true},
+		{func(c *http.Cookie) { c.Secure = false }, false},
+	}
+	for i, tt := range tests {
+		session := New[testSession]()
+		tt.modify(&session.SetCookie)
+		func() {
+			defer func() {
+				if got := recover() != nil; got != tt.wantPanic {
+					t.Errorf("%d: got panic %v; want %v", i, got, tt.wantPanic)
+				}
+			}()
+			session.Handler(http.NotFoundHandler())
+		}()
+	}
+
+	// The cookie is not used with Transport.
+	session := New[testSession]()
+	session.SetCookie.Name = "__Host-id"
+	session.SetCookie.Secure = false
+	session.Transport = HeaderTransport{Name: "X-Session"}
+	defer noPanic(t)
+	session.Handler(http.NotFoundHandler())
+}
+
+func TestDuplicateCookies(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	session := New[testSession]()
+	session.Store = store
+	err := session.Populate(t.Context(),
+		struct {
+			ID      string
+			Session testSession
+		}{"first", testSession{N: 1}},
+		struct {
+			ID      string
+			Session testSession
+		}{"second", testSession{N: 2}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loads []string
+	session.Store = &mockStore[testSession]{
+		LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+			loads = append(loads, id)
+			return store.Load(ctx, id, r)
+		},
+		SaveFunc: store.Save,
+	}
+	var got int
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = session.Read(r.Context()).N
+	}))
+
+	tests := []struct {
+		values    []string
+		want      int
+		wantLoads []string
+	}{
+		{[]string{"stale", "second"}, 2, []string{"stale", "second"}},
+		{[]string{"first", "second"}, 1, []string{"first"}},
+		{[]string{"invalid id", "second", "second"}, 2, []string{"second"}},
+		{[]string{"stale", "stale"}, 0, []string{"stale"}},
+	}
+	for _, tt := range tests {
+		loads = nil
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, v := range tt.values {
+			r.AddCookie(&http.Cookie{Name: session.SetCookie.Name, Value: v})
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("%q: got N = %v; want %v", tt.values, got, tt.want)
+		}
+		if !slices.Equal(loads, tt.wantLoads) {
+			t.Errorf("%q: got loads %q; want %q", tt.values, loads, tt.wantLoads)
+		}
+	}
+}
+
+func TestIsNew(t *testing.T) {
+	session := New[testSession]()
+	var isNew bool
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isNew = session.IsNew(r.Context())
+		session.Get(r.Context())
+		w.Write(nil)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !isNew {
+		t.Error("IsNew() = false for a new session")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if isNew {
+		t.Error("IsNew() = true for a loaded session")
+	}
+}
+
+func TestNewTestContext(t *testing.T) {
+	session := New[testSession]()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if session.Read(r.Context()).N > 0 {
+			session.Get(r.Context()).N++
+		}
+	}
+	for _, tt := range []struct {
+		n, want int
+	}{
+		{0, 0},
+		{1, 2},
+	} {
+		ctx, record := session.NewTestContext(t.Context(), testSession{N: tt.n})
+		r := httptest.NewRequestWithContext(ctx, "GET", "/", nil)
+		handler(httptest.NewRecorder(), r)
+		if got := record.Session.N; got != tt.want {
+			t.Errorf("N = %v: got %v; want %v", tt.n, got, tt.want)
+		}
+		if session.IsNew(ctx) {
+			t.Error("got IsNew = true; want false")
+		}
+	}
+}
+
+func TestPopulate(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	session := New[testSession]()
+	session.Store = store
+	err := session.Populate(t.Context(),
+		struct {
+			ID      string
+			Session testSession
+		}{"id1", testSession{N: 1}},
+		struct {
+			ID      string
+			Session testSession
+		}{"id2", testSession{N: 2}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strconv.Itoa(session.Read(r.Context()).N))
+	}))
+	for id, want := range map[string]string{"id1": "1", "id2": "2"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: session.SetCookie.Name, Value: id})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Body.String(); got != want {
+			t.Errorf("%s: got %v; want %v", id, got, want)
+		}
+	}
+
+	err = session.Populate(t.Context(), struct {
+		ID      string
+		Session testSession
+	}{"invalid id", testSession{}})
+	if err == nil {
+		t.Error("got nil error for an invalid ID")
+	}
+}
+
+func TestLoadErrRecordNotFound(t *testing.T) {
+	store := &mockStore[testSession]{
+		LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+			return false, fmt.Errorf("load %s: %w", id, ErrRecordNotFound)
+		},
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+			return nil
+		},
+	}
+	session := New[testSession]()
+	session.Store = store
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !session.IsNew(r.Context()) {
+			t.Error("got IsNew = false; want true")
+		}
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: session.SetCookie.Name, Value: "missing"})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestFlash(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	session := New[testSession]()
+	session.Store = store
+	var got []string
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.RequestURI {
+		case "/set":
+			session.Flash(r.Context(), "first")
+			session.Flash(r.Context(), "second")
+			http.Redirect(w, r, "/show", http.StatusSeeOther)
+			return
+		case "/show":
+			for {
+				msg, ok := session.ReadFlash(r.Context())
+				if !ok {
+					break
+				}
+				got = append(got, msg)
+			}
+		}
+		w.Write(nil)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/set", nil))
+	cookie := w.Result().Cookies()[0]
+	for _, want := range [][]string{{"first", "second"}, nil} {
+		got = nil
+		r := httptest.NewRequest("GET", "/show", nil)
+		r.AddCookie(cookie)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if !slices.Equal(got, want) {
+			t.Errorf("got %q; want %q", got, want)
+		}
+	}
+	if got := store.m[cookie.Value].Flashes; len(got) != 0 {
+		t.Errorf("stored flashes = %q; want none", got)
+	}
+}
+
+func TestHandlerFunc(t *testing.T) {
+	session := New[testSession]()
+	var order []string
+	middleware := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				session.Get(r.Context()) // the session is available
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	var called bool
+	h := session.Then(middleware("a"), middleware("b"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		session.Get(r.Context())
+		w.Write(nil)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !called {
+		t.Fatal("handler was not called")
+	}
+	if want := []string{"a", "b"}; !slices.Equal(order, want) {
+		t.Errorf("got middlewares called in %q; want %q", order, want)
+	}
+	if got := len(w.Result().Cookies()); got != 1 {
+		t.Errorf("got %v cookies; want 1", got)
+	}
+
+	called = false
+	h = session.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		session.Get(r.Context())
+		w.Write(nil)
+	})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !called {
+		t.Fatal("handler was not called")
+	}
+	if got := len(w.Result().Cookies()); got != 1 {
+		t.Errorf("got %v cookies; want 1", got)
+	}
+}
+
+func TestInvalidIncomingID(t *testing.T) {
+	var loads int
+	session := New[testSession]()
+	session.Store = &mockStore[testSession]{
+		LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+			loads++
+			return false, nil
+		},
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error { return nil },
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		w.Write(nil)
+	}))
+	tests := []struct {
+		value     string
+		wantLoads int
+	}{
+		{"valid-ID_0", 1},
+		{strings.Repeat("A", 128), 1},
+		{strings.Repeat("A", 129), 0},
+		{strings.Repeat("A", 1<<16), 0},
+		{"invalid.id", 0},
+		{"invalid%20id", 0},
+	}
+	for _, tt := range tests {
+		loads = 0
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: tt.value})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if loads != tt.wantLoads {
+			t.Errorf("%.20q: Load was called %v times; want %v", tt.value, loads, tt.wantLoads)
+		}
+		if cookies := w.Result().Cookies(); len(cookies) != 1 {
+			t.Errorf("%.20q: got cookies %v; want a new session", tt.value, cookies)
+		}
+	}
+}
+
+func TestIDValidator(t *testing.T) {
+	var loads []string
+	var n int
+	session := New[testSession]()
+	session.IDGenerator = func() string {
+		n++
+		return strconv.Itoa(n)
+	}
+	session.IDValidator = AlphabetValidator("0123456789")
+	session.Store = &mockStore[testSession]{
+		LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+			loads = append(loads, id)
+			return false, nil
+		},
+		SaveFunc:   func(ctx context.Context, r *Record[testSession]) error { return nil },
+		DeleteFunc: func(ctx context.Context, id string) error { return nil },
+	}
+	var renewErr error
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.URL.Query().Get("renew"); id != "" {
+			renewErr = session.RenewID(r.Context(), id)
+		}
+		session.Get(r.Context())
+		w.Write(nil)
+	}))
+	for _, value := range []string{"123", "abc", "12a", ""} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: value})
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if want := []string{"123"}; !slices.Equal(loads, want) {
+		t.Errorf("got loads %q; want %q", loads, want)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?renew=abc", nil))
+	if renewErr == nil {
+		t.Error("RenewID accepted an invalid ID")
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?renew=42", nil))
+	if renewErr != nil {
+		t.Error(renewErr)
+	}
+
+	var errhCalled bool
+	session.IDGenerator = func() string { return "invalid" }
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		errhCalled = true
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !errhCalled {
+		t.Error("ErrorHandler was not called for an invalid generated ID")
+	}
+}
+
+func TestHeaderTransport(t *testing.T) {
+	session := New[testSession]()
+	session.Transport = HeaderTransport{Name: "Authorization", Scheme: "Bearer"}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/delete" {
+			session.Delete(r.Context())
+		} else {
+			session.Get(r.Context()).N++
+		}
+		w.Write(nil)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("got cookies %v; want none", cookies)
+	}
+	auth := w.Header().Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || token == "" {
+		t.Fatalf("got Authorization %q; want a bearer token", auth)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "bearer "+token)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Authorization"); got != auth {
+		t.Errorf("got Authorization %q; want %q", got, auth)
+	}
+	if got := session.Store.(*memoryStore[testSession]).m[token].Session.N; got != 2 {
+		t.Errorf("got N = %v; want 2", got)
+	}
+
+	r = httptest.NewRequest("GET", "/delete", nil)
+	r.Header.Set("Authorization", auth)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got, ok := w.Header()["Authorization"]; !ok || got[0] != "" {
+		t.Errorf("got Authorization %q; want cleared", got)
+	}
+}
+
+func TestHeaderTransportExtract(t *testing.T) {
+	tests := []struct {
+		transport HeaderTransport
+		values    []string
+		want      string
+		wantOK    bool
+	}{
+		{HeaderTransport{Name: "X-Session"}, []string{"abc"}, "abc", true},
+		{HeaderTransport{Name: "X-Session"}, nil, "", false},
+		{HeaderTransport{Name: "X-Session"}, []string{""}, "", false},
+		{HeaderTransport{Name: "X-Session"}, []string{"abc", "def"}, "", false},
+		{HeaderTransport{Name: "Authorization", Scheme: "Bearer"}, []string{"Bearer abc"}, "abc", true},
+		{HeaderTransport{Name: "Authorization", Scheme: "Bearer"}, []string{"BEARER  abc"}, "abc", true},
+		{HeaderTransport{Name: "Authorization", Scheme: "Bearer"}, []string{"Basic abc"}, "", false},
+		{HeaderTransport{Name: "Authorization", Scheme: "Bearer"}, []string{"abc"}, "", false},
+		{HeaderTransport{Name: "Authorization", Scheme: "Bearer"}, []string{"Bearer "}, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, v := range tt.values {
+			r.Header.Add(tt.transport.Name, v)
+		}
+		got, ok := tt.transport.Extract(r)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%+v %q: got %q, %v; want %q, %v", tt.transport, tt.values, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestClearCookies(t *testing.T) {
+	session := New[testSession]()
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := session.Delete(r.Context()); err != nil {
+			t.Error(err)
+		}
+		w.Write(nil)
+	}))
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, name := range []string{DefaultCookieName, "other"} {
+			r.AddCookie(&http.Cookie{Name: name, Value: "v"})
+		}
+		return r
+	}
+	want := []string{DefaultCookieName}
+
+	for _, clear := range []func(http.ResponseWriter, *http.Request){h.ServeHTTP, session.ClearCookies} {
+		w := httptest.NewRecorder()
+		clear(w, newRequest())
+		var got []string
+		for _, c := range w.Result().Cookies() {
+			if c.MaxAge >= 0 {
+				t.Errorf("%v: got MaxAge %v; want expired", c.Name, c.MaxAge)
+			}
+			got = append(got, c.Name)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("got %v; want %v", got, want)
+		}
+	}
+}
+
+func TestShouldSetCookie(t *testing.T) {
+	tests := []struct {
+		consent           bool
+		saveWithoutCookie bool
+		wantCookie        bool
+		wantSave          bool
+	}{
+		{true, false, true, true},
+		{true, true, true, true},
+		{false, false, false, false},
+		{false, true, false, true},
+	}
+	for _, tt := range tests {
+		store := newMemoryStore[testSession]()
+		session := New[testSession]()
+		session.Store = store
+		session.SaveWithoutCookie = tt.saveWithoutCookie
+		session.ShouldSetCookie = func(r *http.Request) bool {
+			return r.Header.Get("Consent") == "yes"
+		}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context()).N++
+			w.Write(nil)
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.consent {
+			r.Header.Set("Consent", "yes")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := len(w.Result().Cookies()) > 0; got != tt.wantCookie {
+			t.Errorf("%+v: got cookie %v; want %v", tt, got, tt.wantCookie)
+		}
+		if got := len(store.m) > 0; got != tt.wantSave {
+			t.Errorf("%+v: got saved %v; want %v", tt, got, tt.wantSave)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	session := New[testSession]()
+	session.Store = store
+	session.IDGenerator = func() string { return "sameid" }
+	session.Namespace = func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+
+	for i, tenant := range []string{"a", "b", "a"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Tenant", tenant)
+		if i > 0 {
+			r.AddCookie(&http.Cookie{Name: session.SetCookie.Name, Value: "sameid"})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Result().Cookies()[0].Value; got != "sameid" {
+			t.Errorf("cookie value = %q; want sameid", got)
+		}
+	}
+	if got := store.m["a:sameid"].Session.N; got != 2 {
+		t.Errorf("tenant a: got %v; want 2", got)
+	}
+	if got := store.m["b:sameid"].Session.N; got != 1 {
+		t.Errorf("tenant b: got %v; want 1", got)
+	}
+	if _, ok := store.m["sameid"]; ok {
+		t.Error("session saved without namespace")
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	session := New[testSession]()
+	var n int
+	session.IDGenerator = func() string {
+		n++
+		return "id" + strconv.Itoa(n)
+	}
+	var events []string
+	session.OnCreate = func(ctx context.Context, id string) {
+		events = append(events, "create "+id)
+	}
+	session.OnLoad = func(ctx context.Context, id string) {
+		events = append(events, "load "+id)
+	}
+	session.OnRenew = func(ctx context.Context, oldID, newID string) {
+		events = append(events, "renew "+oldID+" "+newID)
+	}
+	session.OnDelete = func(ctx context.Context, id string) {
+		events = append(events, "delete "+id)
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.RequestURI {
+		case "/renew":
+			if err := session.Renew(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+		case "/delete":
+			if err := session.Delete(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Write(nil)
+	}))
+
+	var cookie *http.Cookie
+	for _, target := range []string{"/renew", "/", "/delete"} {
+		r := httptest.NewRequest("GET", target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+	}
+	want := []string{"create id1", "renew id1 id2", "load id2", "load id2", "delete id2"}
+	if !slices.Equal(events, want) {
+		t.Errorf("got %q; want %q", events, want)
+	}
+}
+
+func TestOnSaveError(t *testing.T) {
+	errSave := errors.New("save failed")
+	session := New[testSession]()
+	session.IDGenerator = func() string { return "testid" }
+	session.Store = &mockStore[testSession]{
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+			return errSave
+		},
+	}
+	var events []string
+	session.OnSaveError = func(ctx context.Context, id string, err error) {
+		events = append(events, id+": "+err.Error())
+	}
+	var handled error
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		if r.URL.Path == "/write" {
+			w.Write(nil)
+		}
+	}))
+	for _, target := range []string{"/", "/write"} {
+		events, handled = nil, nil
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+		if want := []string{"testid: save failed"}; !slices.Equal(events, want) {
+			t.Errorf("%s: got %q; want %q", target, events, want)
+		}
+		if handled != errSave {
+			t.Errorf("%s: got %v; want %v", target, handled, errSave)
+		}
+	}
+}
+
+func TestAllowConcurrent(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		store := newMemoryStore[testSession]()
+		session := New[testSession]()
+		session.Store = store
+		session.AllowConcurrent = true
+		session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context()).N++
+			if r.URL.Path == "/slow" {
+				time.Sleep(2 * time.Millisecond)
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+			w.Write(nil)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		cookie := w.Result().Cookies()[0]
+
+		for _, target := range []string{"/slow", "/"} {
+			r := httptest.NewRequest("GET", target, nil)
+			r.AddCookie(cookie)
+			go h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		synctest.Wait()
+		time.Sleep(3 * time.Millisecond)
+		synctest.Wait()
+
+		// Both requests loaded N = 1, and the slower one saved last.
+		if got := store.m[cookie.Value].Session.N; got != 2 {
+			t.Errorf("got N = %v; want 2", got)
+		}
+		if _, ok := session.active.Load(cookie.Value); ok {
+			t.Error("active session not removed")
+		}
+	})
+}
+
+func TestMiddlewareRace(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var errhCalled bool
+		errh := func(w http.ResponseWriter, r *http.Request, err error) {
+			if err.Error() == "httpsession: active session alreadly exists" {
+				errhCalled = true
+			}
+		}
+		session := New[testSession]()
+		session.ErrorHandler = errh
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context())
+			time.Sleep(1 * time.Millisecond)
+			w.Write(nil)
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		cookie := res.Cookies()[0]
+		req1 := httptest.NewRequest("GET", "/", nil)
+		req2 := httptest.NewRequest("GET", "/", nil)
+		req1.AddCookie(cookie)
+		req2.AddCookie(cookie)
+
+		w1 := httptest.NewRecorder()
+		w2 := httptest.NewRecorder()
+
+		go func() {
+			h.ServeHTTP(w1, req1)
+		}()
+		synctest.Wait()
+		if errhCalled {
+			t.Error("unexpected errorHandler call")
+		}
+		go func() {
+			h.ServeHTTP(w2, req2)
+		}()
+		synctest.Wait()
+		if !errhCalled {
+			t.Error("errorHandler was not called")
+		}
+		time.Sleep(1 * time.Millisecond)
+	})
+}
+
+func TestReadOnlyRequest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var errs []error
+		session := New[testSession]()
+		session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			errs = append(errs, err)
+		}
+		session.ReadOnlyRequest = func(r *http.Request) bool {
+			return r.Method == http.MethodGet
+		}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				session.Get(r.Context()).N++
+			} else {
+				if got := session.Read(r.Context()).N; got != 1 {
+					t.Errorf("got N = %v; want 1", got)
+				}
+				time.Sleep(1 * time.Millisecond)
+			}
+			w.Write(nil)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+		cookie := w.Result().Cookies()[0]
+
+		var recorders []*httptest.ResponseRecorder
+		for range 2 {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			recorders = append(recorders, w)
+			go h.ServeHTTP(w, req)
+		}
+		synctest.Wait()
+		time.Sleep(1 * time.Millisecond)
+		synctest.Wait()
+		if len(errs) != 0 {
+			t.Errorf("unexpected errors %v", errs)
+		}
+		for _, w := range recorders {
+			if cookies := w.Result().Cookies(); len(cookies) != 0 {
+				t.Errorf("got cookies %v in a read-only request", cookies)
+			}
+		}
+	})
+}
+
+func TestReadOnlyRequestGetPanics(t *testing.T) {
+	session := New[testSession]()
+	session.ReadOnlyRequest = func(r *http.Request) bool { return true }
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recover() == nil {
+				t.Error("Get did not panic")
+			}
+		}()
+		session.Get(r.Context())
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestResponseController(t *testing.T) {
+	session := New[testSession]()
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.Flush(); err != nil {
+			t.Error(err)
+		}
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !w.Flushed {
+		t.Errorf("Flush was not called")
+	}
+}
+
+func TestFlushSetsCookie(t *testing.T) {
+	session := New[testSession]()
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		w.(http.Flusher).Flush()
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !w.Flushed {
+		t.Errorf("Flush was not called")
+	}
+	if got := len(w.Result().Cookies()); got != 1 {
+		t.Errorf("got %v cookies; want 1", got)
+	}
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), nil
+}
+
+func TestHijack(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	session := New[testSession]()
+	session.Store = store
+	var header http.Header
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		header = w.Header().Clone()
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, r)
+	if !w.hijacked {
+		t.Fatal("Hijack was not called")
+	}
+	if got := len(store.m); got != 1 {
+		t.Errorf("len(store.m) = %v; want 1", got)
+	}
+	if got := header.Get("Set-Cookie"); got == "" {
+		t.Error("Set-Cookie was not set before Hijack")
+	}
+}
+
+type mockStore[T any] struct {
+	LoadFunc          func(context.Context, string, *Record[T]) (bool, error)
+	SaveFunc          func(context.Context, *Record[T]) error
+	DeleteFunc        func(context.Context, string) error
+	DeleteExpiredFunc func(context.Context) error
+}
+
+func (s *mockStore[T]) Load(ctx context.Context, id string, ret *Record[T]) (found bool, err error) {
+	if s.LoadFunc != nil {
+		return s.LoadFunc(ctx, id, ret)
+	}
+	return false, errors.ErrUnsupported
+}
+
+func (s *mockStore[T]) Save(ctx context.Context, r *Record[T]) error {
+	if s.SaveFunc != nil {
+		return s.SaveFunc(ctx, r)
+	}
+	return errors.ErrUnsupported
+}
+
+func (s *mockStore[T]) Delete(ctx context.Context, id string) error {
+	if s.DeleteFunc != nil {
+		return s.DeleteFunc(ctx, id)
+	}
+	return errors.ErrUnsupported
+}
+
+func (s *mockStore[T]) DeleteExpired(ctx context.Context) error {
+	if s.DeleteExpiredFunc != nil {
+		return s.DeleteExpiredFunc(ctx)
+	}
+	return errors.ErrUnsupported
+}
+
+func TestErrorHandler(t *testing.T) {
+	session := New[testSession]()
+	session.Store = &mockStore[testSession]{}
+	var called bool
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		called = true
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		w.Write(nil)
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !called {
+		t.Error("ErrorHandler was not called")
+	}
+}
+
+func TestErrorHandlerOnce(t *testing.T) {
+	var calls int
+	var writeErr error
+	session := New[testSession]()
+	session.Store = &mockStore[testSession]{}
+	session.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		calls++
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		w.WriteHeader(200)
+		_, writeErr = w.Write([]byte("body"))
+		w.(http.Flusher).Flush()
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if calls != 1 {
+		t.Errorf("ErrorHandler was called %v times; want 1", calls)
+	}
+	if writeErr == nil {
+		t.Error("Write after a failed save succeeded")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("got body %q written after ErrorHandler", w.Body)
+	}
+}
+
+func TestErrorHandlerAfterHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+	}{
+		{"no write", func(w http.ResponseWriter) {}},
+		{"header only", func(w http.ResponseWriter) { w.WriteHeader(http.StatusOK) }},
+	}
+	for _, tt := range tests {
+		var calls int
+		session := New[testSession]()
+		session.Store = &mockStore[testSession]{}
+		session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			calls++
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context())
+			tt.write(w)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if calls != 1 {
+			t.Errorf("%s: ErrorHandler was called %v times; want 1", tt.name, calls)
+		}
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: got %v; want %v", tt.name, w.Code, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestAfterSave(t *testing.T) {
+	tests := []struct {
+		path  string
+		write bool
+	}{
+		{"/write", true},
+		{"/no-write", false},
+	}
+	for _, tt := range tests {
+		var calls int
+		session := New[testSession]()
+		session.AfterSave = func(w http.ResponseWriter, r *http.Request, record *Record[testSession]) {
+			calls++
+			if r.URL.Path != tt.path {
+				t.Errorf("got path %v; want %v", r.URL.Path, tt.path)
+			}
+			if got := session.Get(r.Context()); got != &record.Session {
+				t.Errorf("%v: got a record not from the request context", tt.path)
+			}
+			if record.Session.N != 1 {
+				t.Errorf("%v: got N = %v; want 1", tt.path, record.Session.N)
+			}
+		}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context()).N++
+			if tt.write {
+				w.Write(nil)
+			}
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+		if calls != 1 {
+			t.Errorf("%v: AfterSave was called %v times; want 1", tt.path, calls)
+		}
+	}
+}
+
+type lockingStore[T any] struct {
+	mockStore[T]
+	LockFunc func(context.Context, string) (func(), error)
+}
+
+func (s *lockingStore[T]) Lock(ctx context.Context, id string) (func(), error) {
+	return s.LockFunc(ctx, id)
+}
+
+func TestLocker(t *testing.T) {
+	var events []string
+	store := &lockingStore[testSession]{
+		mockStore: mockStore[testSession]{
+			LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+				events = append(events, "load "+id)
+				return false, nil
+			},
+			SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+				events = append(events, "save")
+				return nil
+			},
+		},
+		LockFunc: func(ctx context.Context, id string) (func(), error) {
+			events = append(events, "lock "+id)
+			return func() { events = append(events, "unlock") }, nil
+		},
+	}
+	session := New[testSession]()
+	session.Store = store
+	session.ReadOnlyRequest = func(r *http.Request) bool { return r.Method == http.MethodHead }
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			session.Get(r.Context()).N++
+		}
+		events = append(events, "handler")
+	}))
+
+	tests := []struct {
+		method string
+		cookie bool
+		want   []string
+	}{
+		{"GET", true, []string{"lock sid", "load sid", "handler", "save", "unlock"}},
+		{"GET", false, []string{"handler", "save"}},
+		{"HEAD", true, []string{"load sid", "handler"}},
+	}
+	for _, tt := range tests {
+		events = nil
+		r := httptest.NewRequest(tt.method, "/", nil)
+		if tt.cookie {
+			r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "sid"})
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if !slices.Equal(events, tt.want) {
+			t.Errorf("%v (cookie %v): got %v; want %v", tt.method, tt.cookie, events, tt.want)
+		}
+	}
+
+	store.LockFunc = func(context.Context, string) (func(), error) {
+		return nil, errors.New("lock failed")
+	}
+	var gotErr error
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) { gotErr = err }
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "sid"})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if gotErr == nil || gotErr.Error() != "lock failed" {
+		t.Errorf("got %v; want lock failed", gotErr)
+	}
+}
+
+func TestErrorHandlerNoCookie(t *testing.T) {
+	session := New[testSession]()
+	session.Store = &mockStore[testSession]{
+		LoadFunc: func(context.Context, string, *Record[testSession]) (bool, error) {
+			return false, nil
+		},
+	}
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		w.WriteHeader(200)
+		w.Write(nil)
+		w.(http.Flusher).Flush()
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: session.SetCookie.Name, Value: "unknown"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got %v; want %v", w.Code, http.StatusUnauthorized)
+	}
+	if got := w.Result().Header.Values("Set-Cookie"); len(got) != 0 {
+		t.Errorf("got Set-Cookie %q after ErrorHandler", got)
+	}
+}
+
+func TestDefaultErrorHandler(t *testing.T) {
+	session := New[testSession]()
+	session.Store = &mockStore[testSession]{}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		w.WriteHeader(200)
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 500 {
+		t.Errorf("got %v; want 500", w.Code)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	session := New[testSession]()
+	session.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	session.Store = &mockStore[testSession]{}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		if r.RequestURI == "/write" {
+			w.Write(nil)
+		}
+	}))
+	for _, target := range []string{"/write", "/nowrite"} {
+		buf.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+		if got := buf.String(); !strings.Contains(got, errors.ErrUnsupported.Error()) {
+			t.Errorf("%v: got log %q", target, got)
+		}
+	}
+}
+
+func TestAbsoluteDeadline(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		absoluteTimeout time.Duration
+		wantIdle        time.Time
+		wantAbsolute    time.Time
+	}{
+		{time.Hour, now.Add(time.Hour), now.Add(time.Hour)},
+		{0, now.Add(2 * time.Hour), noAbsoluteDeadline},
+		{-time.Second, now.Add(-time.Second), now.Add(-time.Second)},
+	}
+	for _, tt := range tests {
+		session := New[testSession]()
+		session.now = func() time.Time { return now }
+		session.IdleTimeout = 2 * time.Hour
+		session.AbsoluteTimeout = tt.absoluteTimeout
+		var record *Record[testSession]
+		session.Store = &mockStore[testSession]{
+			SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+				record = r
+				return nil
+			},
+		}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context())
+			w.Write(nil)
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if !record.IdleDeadline.Equal(tt.wantIdle) {
+			t.Errorf("AbsoluteTimeout %v: got IdleDeadline %v; want %v", tt.absoluteTimeout, record.IdleDeadline, tt.wantIdle)
+		}
+		if !record.AbsoluteDeadline.Equal(tt.wantAbsolute) {
+			t.Errorf("AbsoluteTimeout %v: got AbsoluteDeadline %v; want %v", tt.absoluteTimeout, record.AbsoluteDeadline, tt.wantAbsolute)
+		}
+	}
+}
+
+func TestSetAbsoluteDeadline(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		deadline time.Time
+		wantIdle time.Time
+	}{
+		{now.Add(30 * 24 * time.Hour), now.Add(24 * time.Hour)},
+		{now.Add(time.Hour), now.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		session := New[testSession]()
+		session.now = func() time.Time { return now }
+		session.IdleTimeout = 24 * time.Hour
+		var record Record[testSession]
+		session.Store = &mockStore[testSession]{
+			SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+				record = *r
+				return nil
+			},
+		}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.SetAbsoluteDeadline(r.Context(), tt.deadline)
+			w.Write(nil)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if !record.AbsoluteDeadline.Equal(tt.deadline) {
+			t.Errorf("got absolute deadline %v; want %v", record.AbsoluteDeadline, tt.deadline)
+		}
+		if !record.IdleDeadline.Equal(tt.wantIdle) {
+			t.Errorf("got idle deadline %v; want %v", record.IdleDeadline, tt.wantIdle)
+		}
+	}
+}
+
+func TestExtendAbsolute(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		d, max  time.Duration
+		want    time.Time
+		wantErr bool
+	}{
+		{time.Hour, 24 * time.Hour, now.Add(13 * time.Hour), false},
+		{time.Hour, 12*time.Hour + 30*time.Minute, now.Add(12*time.Hour + 30*time.Minute), false},
+		{time.Hour, time.Hour, now.Add(12 * time.Hour), false},
+		{0, 24 * time.Hour, now.Add(12 * time.Hour), false},
+		{-time.Hour, 24 * time.Hour, now.Add(12 * time.Hour), true},
+		{time.Hour, -time.Hour, now.Add(12 * time.Hour), true},
+	}
+	for _, tt := range tests {
+		session := New[testSession]()
+		session.now = func() time.Time { return now }
+		session.AbsoluteTimeout = 12 * time.Hour
+		var record Record[testSession]
+		session.Store = &mockStore[testSession]{
+			SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+				record = *r
+				return nil
+			},
+		}
+		var err error
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context())
+			err = session.ExtendAbsolute(r.Context(), tt.d, tt.max)
+			w.Write(nil)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ExtendAbsolute(%v, %v) = %v; want error %v", tt.d, tt.max, err, tt.wantErr)
+		}
+		if !record.AbsoluteDeadline.Equal(tt.want) {
+			t.Errorf("ExtendAbsolute(%v, %v): got %v; want %v", tt.d, tt.max, record.AbsoluteDeadline, tt.want)
+		}
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	session := New[testSession]()
+	now := time.Now()
+	session.now = func() time.Time { return now }
+	var record Record[testSession]
+	var mu sync.Mutex
+	session.Store = &mockStore[testSession]{
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+			mu.Lock()
+			record = *r
+			mu.Unlock()
+			return nil
+		},
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		w.Write(nil)
+	}))
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for range 100 {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+		})
+		wg.Go(func() {
+			session.SetIdleTimeout(time.Duration(i) * time.Minute)
+			session.SetAbsoluteTimeout(time.Duration(i) * time.Hour)
+		})
+	}
+	wg.Wait()
+
+	session.SetIdleTimeout(time.Minute)
+	session.SetAbsoluteTimeout(time.Hour)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if want := now.Add(time.Minute); !record.IdleDeadline.Equal(want) {
+		t.Errorf("got IdleDeadline %v; want %v", record.IdleDeadline, want)
+	}
+	if want := now.Add(time.Hour); !record.AbsoluteDeadline.Equal(want) {
+		t.Errorf("got AbsoluteDeadline %v; want %v", record.AbsoluteDeadline, want)
+	}
+}
+
+func TestRecordPoolReset(t *testing.T) {
+	session := New[testSession]()
+	session.putRecord(&Record[testSession]{
+		bits:             recordModified | recordDeleted,
+		sameSite:         http.SameSiteNoneMode,
+		keyPrefix:        "ns:",
+		ID:               "stale",
+		IdleDeadline:     time.Now(),
+		AbsoluteDeadline: time.Now(),
+		Session:          testSession{N: 42},
+		Flashes:          []string{"stale"},
+	})
+	if got := session.getRecord(); !reflect.DeepEqual(*got, Record[testSession]{}) {
+		t.Errorf("got %+v; want zero Record", *got)
+	}
+
+	// A panicking handler does not leak its session to the next request.
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			session.Get(r.Context()).N = 42
+			session.Flash(r.Context(), "secret")
+			panic("boom")
+		}
+		if got := *session.Read(r.Context()); got != (testSession{}) {
+			t.Errorf("got %+v; want zero session", got)
+		}
+		if msg, ok := session.ReadFlash(r.Context()); ok {
+			t.Errorf("got flash %q from another request", msg)
+		}
+	}))
+	func() {
+		defer func() { recover() }()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestCleanup(t *testing.T) {
+	session := New[testSession]()
+	record := Record[testSession]{
+		ID: "testid",
+	}
+	if err := session.Store.Save(t.Context(), &record); err != nil {
+		t.Fatal(err)
+	}
+	stop := session.Cleanup(t.Context(), 500*time.Microsecond)
+	defer stop()
+	time.Sleep(1 * time.Millisecond)
+	if found, err := session.Store.Load(t.Context(), record.ID, &record); err != nil || found {
+		t.Fatalf("Load() = %v, %t", err, found)
+	}
+}
+
+func TestCleanupNonPositiveInterval(t *testing.T) {
+	session := New[testSession]()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		func() {
+			defer wantPanic(t, "httpsession: non-positive interval for Cleanup")
+			session.Cleanup(t.Context(), interval)
+		}()
+		func() {
+			defer wantPanic(t, "httpsession: non-positive interval for Cleanup")
+			session.CleanupWithJitter(t.Context(), interval, time.Second)
+		}()
+	}
+}
+
+func TestCleanupWithJitter(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var calls []time.Time
+		store := &mockStore[testSession]{
+			DeleteExpiredFunc: func(ctx context.Context) error {
+				calls = append(calls, time.Now())
+				return nil
+			},
+		}
+		session := New[testSession]()
+		session.Store = store
+		start := time.Now()
+		stop := session.CleanupWithJitter(t.Context(), time.Second, 100*time.Millisecond)
+		time.Sleep(10 * time.Second)
+		stop()
+
+		if len(calls) < 9 || len(calls) > 11 {
+			t.Fatalf("got %d calls; want about 10", len(calls))
+		}
+		prev := start
+		for _, c := range calls {
+			if d := c.Sub(prev); d < 900*time.Millisecond || d > 1100*time.Millisecond {
+				t.Errorf("got interval %v; want 1s ± 100ms", d)
+			}
+			prev = c
+		}
+	})
+}
+
+type batchStore[T any] struct {
+	mockStore[T]
+	DeleteExpiredBatchFunc func(ctx context.Context, limit int) (int, error)
+}
+
+func (s *batchStore[T]) DeleteExpiredBatch(ctx context.Context, limit int) (int, error) {
+	return s.DeleteExpiredBatchFunc(ctx, limit)
+}
+
+func TestCleanupBatch(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		expired := 25
+		var limits []int
+		store := &batchStore[testSession]{
+			DeleteExpiredBatchFunc: func(ctx context.Context, limit int) (int, error) {
+				limits = append(limits, limit)
+				n := min(expired, limit)
+				expired -= n
+				return n, nil
+			},
+		}
+		session := New[testSession]()
+		session.Store = store
+		session.CleanupBatchSize = 10
+		stop := session.Cleanup(t.Context(), time.Second)
+		time.Sleep(1500 * time.Millisecond)
+		stop()
+
+		// DeleteExpired of mockStore is not called.
+		if want := []int{10, 10, 10}; !slices.Equal(limits, want) {
+			t.Errorf("got limits %v; want %v", limits, want)
+		}
+		if expired != 0 {
+			t.Errorf("got %v expired records left; want 0", expired)
+		}
+	})
+}
+
+func TestJittered(t *testing.T) {
+	if got := jittered(time.Second, 0); got != time.Second {
+		t.Errorf("got %v; want %v", got, time.Second)
+	}
+	for range 1000 {
+		if got := jittered(time.Second, time.Millisecond); got < 999*time.Millisecond || got > 1001*time.Millisecond {
+			t.Fatalf("got %v; want 1s ± 1ms", got)
+		}
+	}
+}
+
+func TestCleanupNoLeak(t *testing.T) {
+	session := New[testSession]()
+	before := runtime.NumGoroutine()
+	stop := session.Cleanup(t.Context(), 1*time.Second)
+	stop()
+	stop() // no-op
+	if after := runtime.NumGoroutine(); before != after {
+		t.Fatalf("%v => %v", before, after)
+	}
+
+	// Cancelling ctx alone stops the goroutine.
+	ctx, cancel := context.WithCancel(t.Context())
+	stop = session.Cleanup(ctx, 1*time.Second)
+	defer stop()
+	cancel()
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); after != before && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if before != after {
+		t.Fatalf("%v => %v", before, after)
+	}
+
+	// stop also returns after ctx is done.
+	stop()
+	if after := runtime.NumGoroutine(); before != after {
+		t.Fatalf("%v => %v", before, after)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		store := newMemoryStore[testSession]()
+		session := New[testSession]()
+		session.Store = store
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context()).N++
+			time.Sleep(1 * time.Millisecond)
+			w.Write(nil)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		cookie := w.Result().Cookies()[0]
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		go h.ServeHTTP(w, req)
+		synctest.Wait()
+		if err := session.Invalidate(t.Context(), cookie.Value); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(1 * time.Millisecond)
+		synctest.Wait()
+
+		if _, ok := store.m[cookie.Value]; ok {
+			t.Fatal("invalidated session was saved")
+		}
+		if got := w.Result().Cookies()[0]; got.MaxAge != -1 {
+			t.Fatalf("got MaxAge = %v; want -1", got.MaxAge)
+		}
+	})
+}
+
+func TestIdleDeadlinePrecision(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	var saves int
+	session := New[testSession]()
+	session.IdleDeadlinePrecision = time.Minute
+	session.Store = &mockStore[testSession]{
+		LoadFunc: store.Load,
+		SaveFunc: func(ctx context.Context, r *Record[testSession]) error {
+			saves++
+			return store.Save(ctx, r)
+		},
+	}
+	now := time.Now()
+	session.now = func() time.Time { return now }
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/get" {
+			session.Get(r.Context())
+		} else {
+			session.Read(r.Context())
+		}
+		w.Write(nil)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/get", nil))
+	cookie := w.Result().Cookies()[0]
+	if saves != 1 {
+		t.Fatalf("saves = %v; want 1", saves)
+	}
+
+	for i := range 12 {
+		now = now.Add(10 * time.Second)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		want := 1 + (i+1)/6
+		if saves != want {
+			t.Fatalf("after %v: saves = %v; want %v", 10*time.Second*time.Duration(i+1), saves, want)
+		}
+		if cookies := w.Result().Cookies(); (i+1)%6 == 0 && len(cookies) != 1 {
+			t.Fatalf("got %v cookies; want 1", len(cookies))
+		} else if (i+1)%6 != 0 && len(cookies) != 0 {
+			t.Fatalf("got %v cookies; want 0", len(cookies))
+		}
+	}
+}
+
+func TestSlideIdleDeadline(t *testing.T) {
+	store := newMemoryStore[testSession]()
+	session := New[testSession]()
+	session.Store = store
+	session.IdleTimeout = time.Hour
+	session.AbsoluteTimeout = 0
+	session.SlideIdleDeadline = false
+	now := time.Now()
+	session.now = func() time.Time { return now }
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookie := w.Result().Cookies()[0]
+	start := now
+	for _, tt := range []struct {
+		elapsed time.Duration
+		want    time.Duration // idle deadline from start
+	}{
+		{10 * time.Minute, time.Hour},
+		{30 * time.Minute, time.Hour},
+		{31 * time.Minute, 91 * time.Minute},
+		{60 * time.Minute, 91 * time.Minute},
+		{62 * time.Minute, 122 * time.Minute},
+	} {
+		now = start.Add(tt.elapsed)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		record := store.m[cookie.Value]
+		if got, want := record.IdleDeadline, start.Add(tt.want); !got.Equal(want) {
+			t.Errorf("after %v: got idle deadline %v; want %v", tt.elapsed, got.Sub(start), tt.want)
+		}
+	}
+	if got := store.m[cookie.Value].Session.N; got != 6 {
+		t.Errorf("got N = %v; want 6", got)
+	}
+}
+
+func TestDeadlineExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		idle, absolute time.Time
+	}{
+		{now.Add(-time.Second), now.Add(time.Hour)},
+		{now.Add(time.Hour), now.Add(-time.Second)},
+	}
+	for _, tt := range tests {
+		session := New[testSession]()
+		session.now = func() time.Time { return now }
+		session.Store = &mockStore[testSession]{
+			LoadFunc: func(ctx context.Context, id string, r *Record[testSession]) (bool, error) {
+				r.ID = id
+				r.IdleDeadline = tt.idle
+				r.AbsoluteDeadline = tt.absolute
+				r.Session.N = 42
+				return true, nil
+			},
+		}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got := session.ID(r.Context()); got == "expired" {
+				t.Errorf("got expired session")
+			}
+			if got := session.Read(r.Context()).N; got != 0 {
+				t.Errorf("got %v; want 0", got)
+			}
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: session.SetCookie.Name, Value: "expired"})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+	}
+}
+
+func TestSetCookieSameSite(t *testing.T) {
+	session := New[testSession]()
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context())
+		if r.RequestURI == "/callback" {
+			session.SetCookieSameSite(r.Context(), http.SameSiteNoneMode)
+		}
+		w.Write(nil)
+	}))
+
+	tests := []struct {
+		target string
+		want   http.SameSite
+	}{
+		{"/", http.SameSiteLaxMode},
+		{"/callback", http.SameSiteNoneMode},
+		{"/", http.SameSiteLaxMode},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+		if got := w.Result().Cookies()[0].SameSite; got != tt.want {
+			t.Errorf("%v: got %v; want %v", tt.target, got, tt.want)
+		}
+	}
+
+	// The override does not persist in the store for the next request.
+	var cookie *http.Cookie
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		cookie = w.Result().Cookies()[0]
+		if cookie.SameSite != tt.want {
+			t.Errorf("%v with cookie: got %v; want %v", tt.target, cookie.SameSite, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		trusted []string
+		header  http.Header
+		want    string
+	}{
+		{nil, nil, "192.0.2.1"},
+		{nil, http.Header{"X-Forwarded-For": {"203.0.113.1"}}, "192.0.2.1"},
+		{nil, http.Header{"X-Real-Ip": {"203.0.113.1"}}, "192.0.2.1"},
+		{[]string{"X-Forwarded-For"}, nil, "192.0.2.1"},
+		{[]string{"X-Forwarded-For"}, http.Header{"X-Forwarded-For": {"203.0.113.1"}}, "203.0.113.1"},
+		{[]string{"x-forwarded-for"}, http.Header{"X-Forwarded-For": {"203.0.113.1"}}, "203.0.113.1"},
+		{[]string{"X-Forwarded-For"}, http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.1"}}, "203.0.113.1"},
+		{[]string{"X-Forwarded-For"}, http.Header{"X-Forwarded-For": {"198.51.100.1", "203.0.113.1"}}, "203.0.113.1"},
+		{[]string{"X-Forwarded-For"}, http.Header{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+		{[]string{"X-Forwarded-For"}, http.Header{"X-Forwarded-For": {"bogus"}}, "192.0.2.1"},
+		{[]string{"X-Forwarded-For"}, http.Header{"X-Real-Ip": {"203.0.113.1"}}, "192.0.2.1"},
+		{[]string{"X-Real-IP"}, http.Header{"X-Real-Ip": {"203.0.113.1"}}, "203.0.113.1"},
+		{[]string{"X-Forwarded-For", "X-Real-IP"}, http.Header{"X-Real-Ip": {"203.0.113.1"}}, "203.0.113.1"},
+	}
+	for _, tt := range tests {
+		session := New[testSession]()
+		session.TrustedProxyHeaders = tt.trusted
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = tt.header
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		if got := session.ClientIP(r); got != tt.want {
+			t.Errorf("%v %v: got %q; want %q", tt.trusted, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestIsSecure(t *testing.T) {
+	tests := []struct {
+		trusted []string
+		proto   []string
+		tls     bool
+		want    bool
+	}{
+		{nil, nil, false, false},
+		{nil, nil, true, true},
+		{nil, []string{"https"}, false, false},
+		{[]string{"X-Forwarded-Proto"}, nil, false, false},
+		{[]string{"X-Forwarded-Proto"}, []string{"https"}, false, true},
+		{[]string{"X-Forwarded-Proto"}, []string{"HTTPS"}, false, true},
+		{[]string{"X-Forwarded-Proto"}, []string{"http"}, false, false},
+		{[]string{"X-Forwarded-Proto"}, []string{"http, https"}, false, true},
+		{[]string{"X-Forwarded-Proto"}, []string{"https, http"}, false, false},
+	}
+	for _, tt := range tests {
+		session := New[testSession]()
+		session.TrustedProxyHeaders = tt.trusted
+		target := "http://example.com/"
+		if tt.tls {
+			target = "https://example.com/"
+		}
+		r := httptest.NewRequest("GET", target, nil)
+		for _, v := range tt.proto {
+			r.Header.Add("X-Forwarded-Proto", v)
+		}
+		if got := session.isSecure(r); got != tt.want {
+			t.Errorf("%v %q tls=%v: got %v; want %v", tt.trusted, tt.proto, tt.tls, got, tt.want)
+		}
+	}
+}
+
+func TestAutoSecure(t *testing.T) {
+	tests := []struct {
+		name   string
+		auto   bool
+		target string
+		proto  string
+		want   bool
+	}{
+		{DefaultCookieName, false, "http://example.com/", "", true},
+		{DefaultCookieName, true, "http://example.com/", "", false},
+		{DefaultCookieName, true, "https://example.com/", "", true},
+		{DefaultCookieName, true, "http://example.com/", "https", true},
+		{SecurePrefix + "id", true, "http://example.com/", "", true},
+	}
+	for _, tt := range tests {
+		session := New[testSession]()
+		session.SetCookie.Name = tt.name
+		session.AutoSecure = tt.auto
+		session.TrustedProxyHeaders = []string{"X-Forwarded-Proto"}
+		h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session.Get(r.Context())
+			w.Write(nil)
+		}))
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Result().Cookies()[0].Secure; got != tt.want {
+			t.Errorf("%+v: got Secure %v; want %v", tt, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkHandlerConcurrent measures the throughput of Handler serving many
+// distinct sessions concurrently with the default memory store.
+//
+// Each parallel goroutine owns a disjoint range of pre-created sessions,
+// so requests never collide on the active-session guard. Load tests should
+// follow the same pattern: a session may be served by only one request
+// at a time, and a request for a session that is already being served
+// fails with ErrorHandler.
+func BenchmarkHandlerConcurrent(b *testing.B) {
+	const numSessions = 1024
+	session := New[testSession]()
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		b.Error(err)
+	}
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+
+	cookies := make([]*http.Cookie, numSessions)
+	for i := range cookies {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		cookies[i] = w.Result().Cookies()[0]
+	}
+
+	perG := numSessions / runtime.GOMAXPROCS(0)
+	if perG == 0 {
+		b.Skip("GOMAXPROCS exceeds the number of sessions")
+	}
+	var next sync.Mutex
+	g := 0
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		next.Lock()
+		own := cookies[g*perG : (g+1)*perG]
+		g++
+		next.Unlock()
+		for i := 0; pb.Next(); i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(own[i%len(own)])
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package httpsession
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// KV is the interface that a key-value database implements to be used with [KVStore].
+type KV interface {
+	// Get returns the value associated with key.
+	// If not found, it returns nil and nil.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set sets the value associated with key.
+	// The value may be deleted after ttl.
+	Set(ctx context.Context, key string, val []byte, ttl time.Duration) error
+
+	// Del deletes the value associated with key.
+	Del(ctx context.Context, key string) error
+
+	// Scan calls fn for each key-value pair.
+	// If fn returns an error, Scan stops and returns the error.
+	Scan(ctx context.Context, fn func(key string, val []byte) error) error
+}
+
+// KVStore implements [Store] on top of [KV].
+// Records are encoded in JSON and stored with a TTL derived from their idle deadlines.
+type KVStore[T any] struct {
+	// CompressThreshold, if positive, makes Save compress records whose
+	// JSON encoding is longer than CompressThreshold bytes with DEFLATE.
+	// Stored values are then prefixed with a one-byte header telling
+	// whether they are compressed; Load reads both forms regardless of
+	// this setting, as well as values written without a header.
+	CompressThreshold int
+
+	kv  KV
+	now func() time.Time // for tests
+}
+
+// Header bytes of values written with a positive CompressThreshold.
+// Values without a header are plain JSON and start with '{'.
+const (
+	kvHeaderRaw   byte = 0
+	kvHeaderFlate byte = 1
+)
+
+// NewKVStore returns a new [KVStore] backed by kv.
+func NewKVStore[T any](kv KV) *KVStore[T] {
+	return &KVStore[T]{kv: kv, now: time.Now}
+}
+
+// CheckType reports whether T can be encoded in JSON.
+func (s *KVStore[T]) CheckType() error {
+	var zero Record[T]
+	_, err := json.Marshal(zero)
+	return err
+}
+
+func (s *KVStore[T]) Load(ctx context.Context, id string, ret *Record[T]) (found bool, err error) {
+	val, err := s.kv.Get(ctx, id)
+	if err != nil || val == nil {
+		return false, err
+	}
+	var r Record[T]
+	if err := s.decode(val, &r); err != nil {
+		return false, err
+	}
+	if s.now().After(r.IdleDeadline) {
+		return false, nil
+	}
+	*ret = r
+	return true, nil
+}
+
+func (s *KVStore[T]) Save(ctx context.Context, r *Record[T]) error {
+	ttl := r.IdleDeadline.Sub(s.now())
+	if ttl <= 0 {
+		return nil
+	}
+	val, err := s.encode(r)
+	if err != nil {
+		return err
+	}
+	return s.kv.Set(ctx, r.ID, val, ttl)
+}
+
+func (s *KVStore[T]) encode(r *Record[T]) ([]byte, error) {
+	val, err := json.Marshal(r)
+	if err != nil || s.CompressThreshold <= 0 {
+		return val, err
+	}
+	if len(val) <= s.CompressThreshold {
+		return append([]byte{kvHeaderRaw}, val...), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(kvHeaderFlate)
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(val); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *KVStore[T]) decode(val []byte, r *Record[T]) error {
+	if len(val) == 0 {
+		return json.Unmarshal(val, r)
+	}
+	switch val[0] {
+	case kvHeaderRaw:
+		return json.Unmarshal(val[1:], r)
+	case kvHeaderFlate:
+		data, err := io.ReadAll(flate.NewReader(bytes.NewReader(val[1:])))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, r)
+	case '{':
+		return json.Unmarshal(val, r)
+	default:
+		return fmt.Errorf("httpsession: unknown KVStore header %#x", val[0])
+	}
+}
+
+func (s *KVStore[T]) Delete(ctx context.Context, id string) error {
+	return s.kv.Del(ctx, id)
+}
+
+// DeleteExpired deletes expired records that kv has not deleted yet.
+func (s *KVStore[T]) DeleteExpired(ctx context.Context) error {
+	now := s.now()
+	var expired []string
+	err := s.kv.Scan(ctx, func(key string, val []byte) error {
+		var r Record[T]
+		if err := s.decode(val, &r); err != nil {
+			return err
+		}
+		if now.After(r.IdleDeadline) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := s.kv.Del(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package httpsession
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mapKV struct {
+	mu   sync.Mutex
+	m    map[string][]byte
+	ttls map[string]time.Duration
+}
+
+func newMapKV() *mapKV {
+	return &mapKV{m: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+}
+
+func (kv *mapKV) Get(_ context.Context, key string) ([]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.m[key], nil
+}
+
+func (kv *mapKV) Set(_ context.Context, key string, val []byte, ttl time.Duration) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.m[key] = val
+	kv.ttls[key] = ttl
+	return nil
+}
+
+func (kv *mapKV) Del(_ context.Context, key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	delete(kv.m, key)
+	delete(kv.ttls, key)
+	return nil
+}
+
+func (kv *mapKV) Scan(_ context.Context, fn func(key string, val []byte) error) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for key, val := range kv.m {
+		if err := fn(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestKVStore(t *testing.T) {
+	ctx := t.Context()
+	kv := newMapKV()
+	store := NewKVStore[testSession](kv)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	valid := validRecord
+	valid.Session.N = 42
+	if err := store.Save(ctx, &valid); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, &expiredRecord); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.m[expiredRecord.ID]; ok {
+		t.Fatal("expired record was saved")
+	}
+	if got, want := kv.ttls[valid.ID], valid.IdleDeadline.Sub(now); got != want {
+		t.Errorf("ttl = %v; want %v", got, want)
+	}
+
+	var r Record[testSession]
+	r.Session.N = 1
+	found, err := store.Load(ctx, valid.ID, &r)
+	if err != nil || !found {
+		t.Fatal(found, err)
+	}
+	if r.ID != valid.ID || r.Session.N != 42 || !r.IdleDeadline.Equal(valid.IdleDeadline) {
+		t.Errorf("got %+v; want %+v", r, valid)
+	}
+	if found, err := store.Load(ctx, "missing", &r); err != nil || found {
+		t.Fatal(found, err)
+	}
+
+	now = valid.IdleDeadline.Add(time.Second)
+	if found, err := store.Load(ctx, valid.ID, &r); err != nil || found {
+		t.Fatal(found, err)
+	}
+	if err := store.DeleteExpired(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.m) != 0 {
+		t.Errorf("len(kv.m) = %v; want 0", len(kv.m))
+	}
+}
+
+func TestKVStoreMiddleware(t *testing.T) {
+	kv := newMapKV()
+	session := New[testSession]()
+	session.Store = NewKVStore[testSession](kv)
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+	var cookie *http.Cookie
+	for range 3 {
+		r := httptest.NewRequest("GET", "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		cookie = w.Result().Cookies()[0]
+	}
+	var r Record[testSession]
+	if found, err := session.Store.Load(t.Context(), cookie.Value, &r); err != nil || !found {
+		t.Fatal(found, err)
+	}
+	if r.Session.N != 3 {
+		t.Errorf("got %v; want 3", r.Session.N)
+	}
+}
+
+func TestKVStoreCheckType(t *testing.T) {
+	type badSession struct {
+		C chan int
+	}
+	session := New[badSession]()
+	session.Store = NewKVStore[badSession](newMapKV())
+	defer func() {
+		msg, _ := recover().(string)
+		if !strings.Contains(msg, "httpsession.badSession") || !strings.Contains(msg, "chan int") {
+			t.Fatalf("unexpected panic: %q", msg)
+		}
+	}()
+	session.Handler(http.NotFoundHandler())
+}
+
+func TestKVStoreCompressThreshold(t *testing.T) {
+	type largeSession struct {
+		Data string
+	}
+	ctx := t.Context()
+	kv := newMapKV()
+	store := NewKVStore[largeSession](kv)
+	store.CompressThreshold = 256
+	deadline := time.Now().Add(time.Hour)
+
+	large := &Record[largeSession]{ID: "large", IdleDeadline: deadline}
+	large.Session.Data = strings.Repeat("session data ", 1000)
+	small := &Record[largeSession]{ID: "small", IdleDeadline: deadline}
+	small.Session.Data = "x"
+	for _, r := range []*Record[largeSession]{large, small} {
+		if err := store.Save(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := kv.m[large.ID][0]; got != kvHeaderFlate {
+		t.Errorf("large header = %#x; want %#x", got, kvHeaderFlate)
+	}
+	if got, want := len(kv.m[large.ID]), len(large.Session.Data); got >= want {
+		t.Errorf("compressed size = %v; want less than %v", got, want)
+	}
+	if got := kv.m[small.ID][0]; got != kvHeaderRaw {
+		t.Errorf("small header = %#x; want %#x", got, kvHeaderRaw)
+	}
+
+	// Values written without compression are still readable.
+	store.CompressThreshold = 0
+	legacy := &Record[largeSession]{ID: "legacy", IdleDeadline: deadline}
+	legacy.Session.Data = "legacy"
+	if err := store.Save(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []*Record[largeSession]{large, small, legacy} {
+		var got Record[largeSession]
+		found, err := store.Load(ctx, want.ID, &got)
+		if err != nil || !found {
+			t.Fatal(found, err)
+		}
+		if got.Session != want.Session {
+			t.Errorf("%v: got %.20q; want %.20q", want.ID, got.Session.Data, want.Session.Data)
+		}
+	}
+}
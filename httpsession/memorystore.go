@@ -1,27 +1,88 @@
 package httpsession
 
 import (
+	"container/list"
 	"context"
+	"slices"
 	"sync"
 	"time"
 )
 
+// MemoryStoreOption configures a store created by [NewMemoryStore].
+type MemoryStoreOption func(*memoryStoreConfig)
+
+type memoryStoreConfig struct {
+	maxEntries int
+}
+
+// WithMaxEntries limits the number of records in the store to n.
+// When Save exceeds the limit, the least recently loaded or saved record is evicted,
+// which logs out its user even if the session is still active.
+// If n is not positive, the number of records is not limited.
+func WithMaxEntries(n int) MemoryStoreOption {
+	return func(c *memoryStoreConfig) {
+		c.maxEntries = n
+	}
+}
+
+// NewMemoryStore returns a [Store] that keeps records in memory.
+// It is the default Store of [New].
+func NewMemoryStore[T any](opts ...MemoryStoreOption) Store[T] {
+	s := newMemoryStore[T]()
+	var c memoryStoreConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	s.maxEntries = c.maxEntries
+	return s
+}
+
 type memoryStore[T any] struct {
-	mu sync.RWMutex
-	m  map[string]Record[T]
+	mu         sync.RWMutex
+	m          map[string]memoryEntry[T]
+	aliases    map[string]memoryAlias
+	maxEntries int
+	lru        list.List // IDs from the most to the least recently accessed if maxEntries > 0
+}
+
+type memoryEntry[T any] struct {
+	Record[T]
+	elem *list.Element // element of lru, or nil if maxEntries <= 0
+}
+
+type memoryAlias struct {
+	id       string
+	deadline time.Time
 }
 
 func newMemoryStore[T any]() *memoryStore[T] {
-	return &memoryStore[T]{m: make(map[string]Record[T])}
+	return &memoryStore[T]{
+		m:       make(map[string]memoryEntry[T]),
+		aliases: make(map[string]memoryAlias),
+	}
 }
 
 func (s *memoryStore[T]) Load(_ context.Context, id string, ret *Record[T]) (found bool, err error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	*ret, found = s.m[id]
+	if s.maxEntries > 0 {
+		// Load updates the access time.
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	e, found := s.m[id]
+	if a, ok := s.aliases[id]; !found && ok && time.Now().Before(a.deadline) {
+		id = a.id
+		e, found = s.m[id]
+	}
+	*ret = e.Record
 	if !found || time.Now().After(ret.IdleDeadline) {
 		return false, nil
 	}
+	if e.elem != nil {
+		s.lru.MoveToFront(e.elem)
+	}
 	return true, nil
 }
 
@@ -29,15 +90,58 @@ func (s *memoryStore[T]) Save(_ context.Context, r *Record[T]) error {
 	if time.Now().After(r.IdleDeadline) {
 		return nil
 	}
+	r2 := *r
+	// Clip so that appending to a loaded record does not modify the stored one.
+	r2.Flashes = slices.Clip(slices.Clone(r.Flashes))
 	s.mu.Lock()
-	s.m[r.ID] = *r
+	defer s.mu.Unlock()
+	e := s.m[r.ID]
+	e.Record = r2
+	if s.maxEntries > 0 {
+		if e.elem != nil {
+			s.lru.MoveToFront(e.elem)
+		} else {
+			e.elem = s.lru.PushFront(r.ID)
+		}
+	}
+	s.m[r.ID] = e
+	if s.maxEntries > 0 && len(s.m) > s.maxEntries {
+		s.delete(s.lru.Back().Value.(string))
+	}
+	return nil
+}
+
+// delete deletes the record associated with id. s.mu must be held.
+func (s *memoryStore[T]) delete(id string) {
+	if e, ok := s.m[id]; ok && e.elem != nil {
+		s.lru.Remove(e.elem)
+	}
+	delete(s.m, id)
+}
+
+func (s *memoryStore[T]) Touch(_ context.Context, id string, idleDeadline time.Time) error {
+	s.mu.Lock()
+	if e, ok := s.m[id]; ok {
+		e.IdleDeadline = idleDeadline
+		s.m[id] = e
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Alias implements [Aliaser].
+func (s *memoryStore[T]) Alias(_ context.Context, oldID, newID string, deadline time.Time) error {
+	s.mu.Lock()
+	s.delete(oldID)
+	s.aliases[oldID] = memoryAlias{id: newID, deadline: deadline}
 	s.mu.Unlock()
 	return nil
 }
 
 func (s *memoryStore[T]) Delete(_ context.Context, id string) error {
 	s.mu.Lock()
-	delete(s.m, id)
+	s.delete(id)
+	delete(s.aliases, id)
 	s.mu.Unlock()
 	return nil
 }
@@ -45,9 +149,14 @@ func (s *memoryStore[T]) Delete(_ context.Context, id string) error {
 func (s *memoryStore[T]) DeleteExpired(_ context.Context) error {
 	s.mu.Lock()
 	now := time.Now()
-	for id, r := range s.m {
-		if now.After(r.IdleDeadline) {
-			delete(s.m, id)
+	for id, e := range s.m {
+		if now.After(e.IdleDeadline) {
+			s.delete(id)
+		}
+	}
+	for id, a := range s.aliases {
+		if !now.Before(a.deadline) {
+			delete(s.aliases, id)
 		}
 	}
 	s.mu.Unlock()
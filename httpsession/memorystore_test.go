@@ -20,8 +20,8 @@ var expiredRecord = Record[testSession]{
 func testStore(t *testing.T) *memoryStore[testSession] {
 	t.Helper()
 	store := newMemoryStore[testSession]()
-	store.m[validRecord.ID] = validRecord
-	store.m[expiredRecord.ID] = expiredRecord
+	store.m[validRecord.ID] = memoryEntry[testSession]{Record: validRecord}
+	store.m[expiredRecord.ID] = memoryEntry[testSession]{Record: expiredRecord}
 	return store
 }
 
@@ -141,3 +141,97 @@ func TestMemoryStoreDeleteExpired(t *testing.T) {
 		})
 	}
 }
+
+func TestMemoryStoreTouch(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	deadline := time.Now().Add(48 * time.Hour)
+	if err := store.Touch(ctx, validRecord.ID, deadline); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Touch(ctx, "missing", deadline); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.m[validRecord.ID].IdleDeadline; !got.Equal(deadline) {
+		t.Errorf("got %v; want %v", got, deadline)
+	}
+	if _, ok := store.m["missing"]; ok {
+		t.Error("Touch created a record")
+	}
+}
+
+func TestMemoryStoreMaxEntries(t *testing.T) {
+	ctx := t.Context()
+	store := NewMemoryStore[testSession](WithMaxEntries(2)).(*memoryStore[testSession])
+	deadline := time.Now().Add(time.Hour)
+	for _, id := range []string{"a", "b"} {
+		if err := store.Save(ctx, &Record[testSession]{ID: id, IdleDeadline: deadline}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Loading a makes b the least recently accessed record.
+	var r Record[testSession]
+	if found, err := store.Load(ctx, "a", &r); err != nil || !found {
+		t.Fatalf("Load() = %v, %v", found, err)
+	}
+	if err := store.Save(ctx, &Record[testSession]{ID: "c", IdleDeadline: deadline}); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, got := store.m[id]; got != want {
+			t.Errorf("%q: got found = %v; want %v", id, got, want)
+		}
+	}
+
+	// Saving an existing record does not evict.
+	if err := store.Save(ctx, &Record[testSession]{ID: "a", IdleDeadline: deadline}); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.m) != 2 {
+		t.Errorf("got %v records; want 2", len(store.m))
+	}
+
+	// Deleted records leave the eviction order.
+	if err := store.Delete(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.lru.Len(); got != 1 {
+		t.Errorf("got %v entries in lru; want 1", got)
+	}
+}
+
+func TestMemoryStoreAlias(t *testing.T) {
+	ctx := t.Context()
+	tests := []struct {
+		deadline time.Time
+		found    bool
+	}{
+		{time.Now().Add(time.Minute), true},
+		{time.Now().Add(-time.Minute), false},
+	}
+	for _, tt := range tests {
+		store := testStore(t)
+		if err := store.Save(ctx, &Record[testSession]{ID: "old", IdleDeadline: validRecord.IdleDeadline}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Alias(ctx, "old", validRecord.ID, tt.deadline); err != nil {
+			t.Fatal(err)
+		}
+		var r Record[testSession]
+		found, err := store.Load(ctx, "old", &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != tt.found {
+			t.Errorf("got found = %v; want %v", found, tt.found)
+		} else if found && r.ID != validRecord.ID {
+			t.Errorf("got %v; want %v", r.ID, validRecord.ID)
+		}
+		if err := store.DeleteExpired(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := store.aliases["old"]; ok != tt.found {
+			t.Errorf("got alias kept = %v; want %v", ok, tt.found)
+		}
+	}
+}
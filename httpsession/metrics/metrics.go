@@ -0,0 +1,128 @@
+// Package metrics counts events of an [httpsession.SessionStore] through its
+// hooks, e.g. to export them as Prometheus metrics.
+//
+// The package does not depend on a metrics library; a prometheus.Collector
+// can be written as:
+//
+//	type collector struct{ m *metrics.Metrics }
+//
+//	func (c collector) Describe(ch chan<- *prometheus.Desc) {
+//		prometheus.DescribeByCollect(c, ch)
+//	}
+//
+//	func (c collector) Collect(ch chan<- prometheus.Metric) {
+//		for name, v := range c.m.Snapshot().All() {
+//			desc := prometheus.NewDesc("httpsession_"+name+"_total", "Number of httpsession "+name+".", nil, nil)
+//			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v))
+//		}
+//	}
+//
+//	prometheus.MustRegister(collector{metrics.Observe(session)})
+package metrics
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/yhnw/tmp/httpsession"
+)
+
+// Metrics counts events of a SessionStore.
+type Metrics struct {
+	creates    atomic.Uint64
+	loads      atomic.Uint64
+	renews     atomic.Uint64
+	deletes    atomic.Uint64
+	saves      atomic.Uint64
+	saveErrors atomic.Uint64
+}
+
+// Snapshot holds the counts of events at a point in time.
+type Snapshot struct {
+	// Creates counts sessions created because no valid session was found,
+	// i.e. misses of Store.
+	Creates uint64
+	// Loads counts sessions loaded from Store.
+	Loads uint64
+	// Renews counts renewed session IDs.
+	Renews uint64
+	// Deletes counts sessions deleted by SessionStore.Delete.
+	Deletes uint64
+	// Saves counts sessions saved to Store.
+	Saves uint64
+	// SaveErrors counts sessions that failed to be saved to Store.
+	SaveErrors uint64
+}
+
+// Observe sets the hooks of m to count its events and returns the counts.
+// Hooks already set are still called. Observe must be called before
+// m.Handler, since the fields of m must not be mutated afterwards.
+func Observe[T any](m *httpsession.SessionStore[T]) *Metrics {
+	c := new(Metrics)
+	onCreate, onLoad, onRenew, onDelete := m.OnCreate, m.OnLoad, m.OnRenew, m.OnDelete
+	afterSave, onSaveError := m.AfterSave, m.OnSaveError
+	m.OnCreate = func(ctx context.Context, id string) {
+		c.creates.Add(1)
+		if onCreate != nil {
+			onCreate(ctx, id)
+		}
+	}
+	m.OnLoad = func(ctx context.Context, id string) {
+		c.loads.Add(1)
+		if onLoad != nil {
+			onLoad(ctx, id)
+		}
+	}
+	m.OnRenew = func(ctx context.Context, oldID, newID string) {
+		c.renews.Add(1)
+		if onRenew != nil {
+			onRenew(ctx, oldID, newID)
+		}
+	}
+	m.OnDelete = func(ctx context.Context, id string) {
+		c.deletes.Add(1)
+		if onDelete != nil {
+			onDelete(ctx, id)
+		}
+	}
+	m.AfterSave = func(w http.ResponseWriter, r *http.Request, record *httpsession.Record[T]) {
+		c.saves.Add(1)
+		if afterSave != nil {
+			afterSave(w, r, record)
+		}
+	}
+	m.OnSaveError = func(ctx context.Context, id string, err error) {
+		c.saveErrors.Add(1)
+		if onSaveError != nil {
+			onSaveError(ctx, id, err)
+		}
+	}
+	return c
+}
+
+// Snapshot returns the current counts.
+// Each count is read atomically, but not all of them at once.
+func (c *Metrics) Snapshot() Snapshot {
+	return Snapshot{
+		Creates:    c.creates.Load(),
+		Loads:      c.loads.Load(),
+		Renews:     c.renews.Load(),
+		Deletes:    c.deletes.Load(),
+		Saves:      c.saves.Load(),
+		SaveErrors: c.saveErrors.Load(),
+	}
+}
+
+// All yields the counts of s with their names in snake case, e.g. "save_errors".
+func (s Snapshot) All() iter.Seq2[string, uint64] {
+	return func(yield func(string, uint64) bool) {
+		_ = yield("creates", s.Creates) &&
+			yield("loads", s.Loads) &&
+			yield("renews", s.Renews) &&
+			yield("deletes", s.Deletes) &&
+			yield("saves", s.Saves) &&
+			yield("save_errors", s.SaveErrors)
+	}
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yhnw/tmp/httpsession"
+)
+
+type testSession struct {
+	N int
+}
+
+// failingStore fails to save sessions with N > 2.
+type failingStore struct {
+	httpsession.Store[testSession]
+}
+
+func (s failingStore) Save(ctx context.Context, r *httpsession.Record[testSession]) error {
+	if r.Session.N > 2 {
+		return errors.New("full")
+	}
+	return s.Store.Save(ctx, r)
+}
+
+func TestObserve(t *testing.T) {
+	session := httpsession.New[testSession]()
+	session.Store = failingStore{httpsession.NewMemoryStore[testSession]()}
+	session.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {}
+	var loads int
+	session.OnLoad = func(ctx context.Context, id string) { loads++ }
+	m := Observe(session)
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/renew":
+			if err := session.Renew(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+		case "/delete":
+			if err := session.Delete(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+
+	var cookie *http.Cookie
+	for _, target := range []string{"/", "/renew", "/", "/delete"} {
+		r := httptest.NewRequest("GET", target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+	}
+
+	want := Snapshot{Creates: 1, Loads: 3, Renews: 1, Deletes: 1, Saves: 2, SaveErrors: 1}
+	if got := m.Snapshot(); got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if loads != 3 {
+		t.Errorf("existing OnLoad was called %v times; want 3", loads)
+	}
+	all := maps.Collect(want.All())
+	if len(all) != 6 || all["save_errors"] != 1 || all["loads"] != 3 {
+		t.Errorf("All() = %v", all)
+	}
+}
@@ -0,0 +1,46 @@
+// Package pgstore implements [httpsession.Store] backed by PostgreSQL.
+//
+// The table must be created beforehand:
+//
+//	CREATE TABLE IF NOT EXISTS httpsession (
+//		id TEXT NOT NULL PRIMARY KEY,
+//		idle_deadline TIMESTAMPTZ NOT NULL,
+//		absolute_deadline TIMESTAMPTZ NOT NULL,
+//		data BYTEA NOT NULL,
+//		flashes TEXT
+//	);
+//	CREATE INDEX IF NOT EXISTS httpsession_idle_deadline_idx ON httpsession(idle_deadline);
+//
+// Store is [sqlstore.Store] with the [sqlstore.Postgres] dialect.
+// The package does not import a driver; register one such as
+// github.com/jackc/pgx/v5/stdlib before calling [New].
+package pgstore
+
+import (
+	"database/sql"
+
+	"github.com/yhnw/tmp/httpsession/sqlstore"
+)
+
+// DefaultTable is the default table name.
+const DefaultTable = sqlstore.DefaultTable
+
+type Store[T any] struct {
+	*sqlstore.Store[T]
+}
+
+// Option configures a [Store].
+type Option = sqlstore.Option
+
+// WithTable sets the name of the table that stores sessions.
+// It allows multiple applications to share one database.
+// The name may be qualified with a schema name, e.g. "app.httpsession".
+func WithTable(name string) Option {
+	return sqlstore.WithTable(name)
+}
+
+// New returns a new [Store].
+// It panics if the table name is invalid or a statement cannot be prepared.
+func New[T any](db *sql.DB, opts ...Option) *Store[T] {
+	return &Store[T]{sqlstore.New[T](db, sqlstore.Postgres, opts...)}
+}
@@ -0,0 +1,169 @@
+package pgstore
+
+import (
+	"database/sql"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/yhnw/tmp/httpsession"
+)
+
+type testSession struct {
+	N int
+}
+
+var (
+	dsn        = flag.String("dsn", "", "PostgreSQL data source name; tests that need a database are skipped if empty")
+	driverName = flag.String("driver", "pgx", "registered database/sql driver name")
+)
+
+var (
+	recordNotExpired = &httpsession.Record[testSession]{
+		ID:               "notexpired",
+		IdleDeadline:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		AbsoluteDeadline: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	recordExpired = &httpsession.Record[testSession]{
+		ID:               "expired",
+		IdleDeadline:     time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		AbsoluteDeadline: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+)
+
+// testTable is the table created and dropped by tests, so that they never
+// touch DefaultTable in the database that -dsn points to.
+const testTable = "pgstore_test_httpsession"
+
+func testStore(t *testing.T) *Store[testSession] {
+	t.Helper()
+	if *dsn == "" {
+		t.Skip("-dsn is not set")
+	}
+	db, err := sql.Open(*driverName, *dsn)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`DROP TABLE IF EXISTS ` + testTable); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DROP TABLE IF EXISTS ` + testTable) })
+	if _, err := db.Exec(`
+	CREATE TABLE ` + testTable + ` (
+		id TEXT NOT NULL PRIMARY KEY,
+		idle_deadline TIMESTAMPTZ NOT NULL,
+		absolute_deadline TIMESTAMPTZ NOT NULL,
+		data BYTEA NOT NULL,
+		flashes TEXT
+	);`); err != nil {
+		t.Fatal(err)
+	}
+	store := New[testSession](db, WithTable(testTable))
+	if err := store.Save(t.Context(), recordNotExpired); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(t.Context(), recordExpired); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestInvalidTable(t *testing.T) {
+	for _, table := range []string{"", "1table", "a b", "t; DROP TABLE x", `"quoted"`, "a.b.c"} {
+		t.Run("", func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: want panic", table)
+				}
+			}()
+			New[testSession](nil, WithTable(table))
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	var record httpsession.Record[testSession]
+	found, err := store.Load(ctx, recordNotExpired.ID, &record)
+	if err != nil || !found {
+		t.Fatal(found, err)
+	}
+	found, err = store.Load(ctx, recordExpired.ID, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Errorf("unexpected record %#v", record)
+	}
+}
+
+func TestSave(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	record := &httpsession.Record[testSession]{
+		ID:               "savetest",
+		IdleDeadline:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		AbsoluteDeadline: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		Session:          testSession{N: 1},
+	}
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+	record.AbsoluteDeadline = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+	record.Session.N = 2
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, record.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("record not found")
+	}
+	if got.Session != record.Session || !got.AbsoluteDeadline.Equal(record.AbsoluteDeadline) {
+		t.Errorf("got %+v; want %+v", got, record)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	if err := store.Delete(ctx, recordNotExpired.ID); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, recordNotExpired.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("record found")
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	if err := store.DeleteExpired(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, recordExpired.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expired record found")
+	}
+	found, err = store.Load(ctx, recordNotExpired.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("record not found")
+	}
+}
@@ -1,33 +1,199 @@
+// Package sqlite3store implements [httpsession.Store] backed by SQLite.
+//
+// [Migrate] creates the tables. Tables created by earlier versions lack the
+// flashes column that stores [httpsession.Record.Flashes]. [Store] works on
+// them, but fails to save a record with flashes until they are upgraded,
+// either by calling Migrate again or by running:
+//
+//	ALTER TABLE httpsession ADD COLUMN flashes TEXT;
 package sqlite3store
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/yhnw/tmp/httpsession"
 )
 
+// DefaultTable is the default table name.
+const DefaultTable = "httpsession"
+
 type Store[T any] struct {
+	db                *sql.DB
 	loadStmt          *sql.Stmt
 	saveStmt          *sql.Stmt
 	deleteStmt        *sql.Stmt
 	deleteExpiredStmt *sql.Stmt
+	deleteBatchStmt   *sql.Stmt
+	touchStmt         *sql.Stmt
+	exportStmt        *sql.Stmt
+	queryJSONStmt     *sql.Stmt
+	clock             func() time.Time
+	noFlashes         bool // the table lacks the flashes column
+}
+
+type options struct {
+	table   string
+	clock   func() time.Time
+	lockTTL time.Duration
+}
+
+// Option configures a [Store].
+type Option func(*options)
+
+// WithTable sets the name of the table that stores sessions.
+// It allows multiple applications to share one database file.
+func WithTable(name string) Option {
+	return func(o *options) {
+		o.table = name
+	}
+}
+
+// WithClock makes the store decide whether records have expired with the
+// time returned by now, e.g. time.Now of the application, instead of the
+// clock of the database. Without it, a skew between the two clocks makes
+// a record be expired for one side and valid for the other.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.clock = now
+	}
+}
+
+// WithLockTTL sets how long a lock taken by [LockingStore.Lock] is held at most,
+// so that a lock left by a crashed process does not block its session forever.
+// The default is 30 seconds. It should be longer than any request takes.
+func WithLockTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.lockTTL = d
+	}
+}
+
+var identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// New is like [NewSessionStore] but panics if it returns an error.
+func New[T any](db *sql.DB, opts ...Option) *Store[T] {
+	s, err := NewSessionStore[T](db, opts...)
+	if err != nil {
+		panic("sqlite3store.New: " + err.Error())
+	}
+	return s
+}
+
+// NewSessionStore returns a new [Store].
+// It returns an error if the table name is invalid or the statements
+// cannot be prepared, e.g. because the table does not exist.
+func NewSessionStore[T any](db *sql.DB, opts ...Option) (*Store[T], error) {
+	o := options{table: DefaultTable}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !identRegexp.MatchString(o.table) {
+		return nil, fmt.Errorf("invalid table name %q", o.table)
+	}
+	hasFlashes, err := hasFlashesColumn(context.Background(), db, o.table)
+	if err != nil {
+		return nil, err
+	}
+	q := func(query string) string {
+		if !hasFlashes {
+			query = strings.ReplaceAll(query, "{{flashes}}", "NULL")
+		}
+		return withTable(strings.ReplaceAll(query, "{{flashes}}", "flashes"), o.table)
+	}
+	save := querySave
+	if !hasFlashes {
+		save = querySaveWithoutFlashes
+	}
+	loadStmt, err1 := db.Prepare(q(queryLoad))
+	saveStmt, err2 := db.Prepare(q(save))
+	deleteStmt, err3 := db.Prepare(q(queryDelete))
+	deleteExpiredStmt, err4 := db.Prepare(q(queryDeleteExpired))
+	exportStmt, err5 := db.Prepare(q(queryExport))
+	touchStmt, err6 := db.Prepare(q(queryTouch))
+	queryJSONStmt, err7 := db.Prepare(q(queryByJSONField))
+	deleteBatchStmt, err8 := db.Prepare(q(queryDeleteExpiredBatch))
+	if err := errors.Join(err1, err2, err3, err4, err5, err6, err7, err8); err != nil {
+		return nil, fmt.Errorf("sql.DB.Prepare: %v", err)
+	}
+	return &Store[T]{
+		db:                db,
+		loadStmt:          loadStmt,
+		saveStmt:          saveStmt,
+		deleteStmt:        deleteStmt,
+		deleteExpiredStmt: deleteExpiredStmt,
+		deleteBatchStmt:   deleteBatchStmt,
+		exportStmt:        exportStmt,
+		touchStmt:         touchStmt,
+		queryJSONStmt:     queryJSONStmt,
+		clock:             o.clock,
+		noFlashes:         !hasFlashes,
+	}, nil
+}
+
+// hasFlashesColumn reports whether table has the flashes column.
+func hasFlashesColumn(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT count(*) FROM pragma_table_info(?) WHERE name = 'flashes'`, table).Scan(&n)
+	return n > 0, err
+}
+
+const querySchema = `
+CREATE TABLE IF NOT EXISTS {{table}} (
+	id TEXT NOT NULL PRIMARY KEY,
+	idle_deadline TEXT NOT NULL,
+	absolute_deadline TEXT NOT NULL,
+	data BLOB NOT NULL,
+	flashes TEXT
+);
+CREATE INDEX IF NOT EXISTS {{table}}_idle_deadline_idx ON {{table}}(idle_deadline);
+CREATE TABLE IF NOT EXISTS {{table}}_lock (
+	id TEXT NOT NULL PRIMARY KEY,
+	token TEXT NOT NULL,
+	deadline TEXT NOT NULL
+);`
+
+// Migrate creates the table and the index on idle_deadline used by [Store],
+// and the table {{table}}_lock used by [LockingStore], if they do not exist.
+// It adds the flashes column to a table created by an earlier version.
+// It accepts the same options as [New].
+func Migrate(ctx context.Context, db *sql.DB, opts ...Option) error {
+	o := options{table: DefaultTable}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !identRegexp.MatchString(o.table) {
+		return fmt.Errorf("sqlite3store: invalid table name %q", o.table)
+	}
+	if _, err := db.ExecContext(ctx, withTable(querySchema, o.table)); err != nil {
+		return err
+	}
+	hasFlashes, err := hasFlashesColumn(ctx, db, o.table)
+	if err != nil || hasFlashes {
+		return err
+	}
+	_, err = db.ExecContext(ctx, withTable(`ALTER TABLE {{table}} ADD COLUMN flashes TEXT`, o.table))
+	return err
 }
 
-func New[T any](db *sql.DB) *Store[T] {
-	loadStmt, err1 := db.Prepare(queryLoad)
-	saveStmt, err2 := db.Prepare(querySave)
-	deleteStmt, err3 := db.Prepare(queryDelete)
-	deleteExpiredStmt, err4 := db.Prepare(queryDeleteExpired)
-	if err := errors.Join(err1, err2, err3, err4); err != nil {
-		panic(fmt.Sprintf("sqlite3store.NewSessionStore: sql.DB.Prepare: %v", err))
+// now returns the current time as a query parameter,
+// or nil to use the clock of the database.
+func (s *Store[T]) now() any {
+	if s.clock == nil {
+		return nil
 	}
-	return &Store[T]{loadStmt, saveStmt, deleteStmt, deleteExpiredStmt}
+	return rfc3339Nano(s.clock())
+}
+
+func withTable(query, table string) string {
+	return strings.ReplaceAll(query, "{{table}}", table)
 }
 
 type rfc3339Nano time.Time
@@ -59,24 +225,57 @@ func (t rfc3339Nano) Value() (driver.Value, error) {
 	return (time.Time)(t).UTC().Format(time.RFC3339Nano), nil
 }
 
+// flashes stores httpsession.Record.Flashes as a JSON array, or NULL if empty.
+type flashes []string
+
+func (f *flashes) Scan(src any) error {
+	*f = nil
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), (*[]string)(f))
+	case []byte:
+		return json.Unmarshal(v, (*[]string)(f))
+	default:
+		return fmt.Errorf("sqlite3store: cannot scan to []string: (%#v, %T)", src, src)
+	}
+}
+
+func (f flashes) Value() (driver.Value, error) {
+	if len(f) == 0 {
+		return nil, nil
+	}
+	return json.Marshal([]string(f))
+}
+
 const queryLoad = `
 SELECT
 	id,
 	idle_deadline,
 	absolute_deadline,
-	data
+	data,
+	{{flashes}}
 FROM
-	httpsession
+	{{table}}
 WHERE
-	id = ? AND julianday(idle_deadline) > julianday('now')`
+	id = ? AND julianday(idle_deadline) > julianday(coalesce(?, 'now'))`
+
+// CheckType reports whether T can be encoded in JSON.
+func (s *Store[T]) CheckType() error {
+	var zero T
+	_, err := json.Marshal(zero)
+	return err
+}
 
 func (s *Store[T]) Load(ctx context.Context, id string, r *httpsession.Record[T]) (bool, error) {
 	var buf []byte
-	err := s.loadStmt.QueryRowContext(ctx, id).Scan(
+	err := s.loadStmt.QueryRowContext(ctx, id, s.now()).Scan(
 		&r.ID,
 		(*rfc3339Nano)(&r.IdleDeadline),
 		(*rfc3339Nano)(&r.AbsoluteDeadline),
 		&buf,
+		(*flashes)(&r.Flashes),
 	)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -85,37 +284,289 @@ func (s *Store[T]) Load(ctx context.Context, id string, r *httpsession.Record[T]
 }
 
 const querySave = `
-INSERT INTO httpsession (
+INSERT INTO {{table}} (
+	id, idle_deadline, absolute_deadline, data, flashes
+) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+	idle_deadline = excluded.idle_deadline,
+	absolute_deadline = excluded.absolute_deadline,
+	data = excluded.data,
+	flashes = excluded.flashes`
+
+const querySaveWithoutFlashes = `
+INSERT INTO {{table}} (
 	id, idle_deadline, absolute_deadline, data
 ) VALUES (?, ?, ?, ?)
 ON CONFLICT(id) DO UPDATE SET
- 	idle_deadline = excluded.idle_deadline,
- 	data = excluded.data`
+	idle_deadline = excluded.idle_deadline,
+	absolute_deadline = excluded.absolute_deadline,
+	data = excluded.data`
+
+// errNoFlashesColumn is returned when saving a record with flashes
+// to a table that lacks the flashes column.
+var errNoFlashesColumn = errors.New("sqlite3store: cannot save flashes: the table has no flashes column; call Migrate to add it")
 
 func (s *Store[T]) Save(ctx context.Context, r *httpsession.Record[T]) error {
-	buf, err := json.Marshal(r.Session)
+	args, err := s.saveArgs(r)
 	if err != nil {
 		return err
 	}
-	_, err = s.saveStmt.ExecContext(ctx,
+	_, err = s.saveStmt.ExecContext(ctx, args...)
+	return err
+}
+
+// saveArgs returns the arguments of the save statement for r.
+func (s *Store[T]) saveArgs(r *httpsession.Record[T]) ([]any, error) {
+	buf, err := json.Marshal(r.Session)
+	if err != nil {
+		return nil, err
+	}
+	args := []any{
 		r.ID,
 		rfc3339Nano(r.IdleDeadline),
 		rfc3339Nano(r.AbsoluteDeadline),
 		buf,
-	)
+	}
+	if s.noFlashes {
+		if len(r.Flashes) > 0 {
+			return nil, errNoFlashesColumn
+		}
+		return args, nil
+	}
+	return append(args, flashes(r.Flashes)), nil
+}
+
+const queryTouch = `UPDATE {{table}} SET idle_deadline = ? WHERE id = ?`
+
+// Touch updates idle_deadline of a session record associated with id
+// without rewriting data.
+func (s *Store[T]) Touch(ctx context.Context, id string, idleDeadline time.Time) error {
+	_, err := s.touchStmt.ExecContext(ctx, rfc3339Nano(idleDeadline), id)
 	return err
 }
 
-const queryDelete = `DELETE FROM httpsession WHERE id = ?`
+const queryDelete = `DELETE FROM {{table}} WHERE id = ?`
 
 func (s *Store[T]) Delete(ctx context.Context, id string) error {
 	_, err := s.deleteStmt.ExecContext(ctx, id)
 	return err
 }
 
-const queryDeleteExpired = `DELETE FROM httpsession WHERE julianday(idle_deadline) <= julianday('now')`
+const queryDeleteExpired = `DELETE FROM {{table}} WHERE julianday(idle_deadline) <= julianday(coalesce(?, 'now'))`
 
 func (s *Store[T]) DeleteExpired(ctx context.Context) error {
-	_, err := s.deleteExpiredStmt.ExecContext(ctx)
+	_, err := s.deleteExpiredStmt.ExecContext(ctx, s.now())
 	return err
 }
+
+const queryDeleteExpiredBatch = `
+DELETE FROM {{table}} WHERE id IN (
+	SELECT id FROM {{table}} WHERE julianday(idle_deadline) <= julianday(coalesce(?, 'now')) LIMIT ?
+)`
+
+// DeleteExpiredBatch deletes at most limit expired records,
+// and returns the number of deleted records.
+func (s *Store[T]) DeleteExpiredBatch(ctx context.Context, limit int) (deleted int, err error) {
+	res, err := s.deleteBatchStmt.ExecContext(ctx, s.now(), limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+const queryExport = `
+SELECT
+	id,
+	idle_deadline,
+	absolute_deadline,
+	data,
+	{{flashes}}
+FROM
+	{{table}}
+WHERE
+	julianday(idle_deadline) > julianday(coalesce(?, 'now'))`
+
+// Export calls fn for each session record that has not expired.
+// The record passed to fn is reused, so fn must not retain it.
+// If fn returns an error, Export stops and returns the error.
+func (s *Store[T]) Export(ctx context.Context, fn func(*httpsession.Record[T]) error) error {
+	rows, err := s.exportStmt.QueryContext(ctx, s.now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var r httpsession.Record[T]
+	for rows.Next() {
+		var buf []byte
+		if err := rows.Scan(
+			&r.ID,
+			(*rfc3339Nano)(&r.IdleDeadline),
+			(*rfc3339Nano)(&r.AbsoluteDeadline),
+			&buf,
+			(*flashes)(&r.Flashes),
+		); err != nil {
+			return err
+		}
+		var zero T
+		r.Session = zero
+		if err := json.Unmarshal(buf, &r.Session); err != nil {
+			return err
+		}
+		if err := fn(&r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Import saves records in a single transaction.
+// Existing records with the same IDs are overwritten.
+func (s *Store[T]) Import(ctx context.Context, records []*httpsession.Record[T]) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt := tx.StmtContext(ctx, s.saveStmt)
+	for _, r := range records {
+		args, err := s.saveArgs(r)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const queryByJSONField = `
+SELECT
+	id,
+	idle_deadline,
+	absolute_deadline,
+	data,
+	{{flashes}}
+FROM
+	{{table}}
+WHERE
+	json_extract(CAST(data AS TEXT), ?) = ? AND julianday(idle_deadline) > julianday(coalesce(?, 'now'))`
+
+// QueryByJSONField returns the session records that have not expired and
+// whose JSON-encoded session has value at path, e.g. "$.Role", using
+// SQLite's json_extract. It requires the JSON1 functions, which are built
+// into SQLite since 3.38.0 and into github.com/mattn/go-sqlite3 by default.
+// Since it scans the whole table, it is meant for administrative use,
+// not for serving requests.
+func (s *Store[T]) QueryByJSONField(ctx context.Context, path string, value any) ([]httpsession.Record[T], error) {
+	rows, err := s.queryJSONStmt.QueryContext(ctx, path, value, s.now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []httpsession.Record[T]
+	for rows.Next() {
+		var r httpsession.Record[T]
+		var buf []byte
+		if err := rows.Scan(
+			&r.ID,
+			(*rfc3339Nano)(&r.IdleDeadline),
+			(*rfc3339Nano)(&r.AbsoluteDeadline),
+			&buf,
+			(*flashes)(&r.Flashes),
+		); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buf, &r.Session); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// lockRetryInterval is the interval at which Lock retries to take a lock.
+const lockRetryInterval = 10 * time.Millisecond
+
+const queryLock = `
+INSERT INTO {{table}}_lock (id, token, deadline) VALUES (?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+	token = excluded.token,
+	deadline = excluded.deadline
+WHERE julianday({{table}}_lock.deadline) <= julianday(?)`
+
+const queryUnlock = `DELETE FROM {{table}}_lock WHERE id = ? AND token = ?`
+
+// LockingStore is a [Store] that also implements [httpsession.Locker]
+// with a row in the table {{table}}_lock, which is created by [Migrate].
+// [httpsession.SessionStore.Handler] then makes concurrent requests for
+// a session wait for each other, even across processes sharing the
+// database, instead of rejecting them. Each request costs an extra
+// INSERT and DELETE, so use it only when sessions are served by several
+// processes and concurrent requests must not fail.
+type LockingStore[T any] struct {
+	*Store[T]
+	lockStmt   *sql.Stmt
+	unlockStmt *sql.Stmt
+	lockTTL    time.Duration
+}
+
+// NewLockingStore returns a new [LockingStore].
+// It accepts the same options as [NewSessionStore] and [WithLockTTL].
+// It returns an error if the statements cannot be prepared,
+// e.g. because the table {{table}}_lock does not exist.
+func NewLockingStore[T any](db *sql.DB, opts ...Option) (*LockingStore[T], error) {
+	store, err := NewSessionStore[T](db, opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := options{table: DefaultTable, lockTTL: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	lockStmt, err1 := db.Prepare(withTable(queryLock, o.table))
+	unlockStmt, err2 := db.Prepare(withTable(queryUnlock, o.table))
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, fmt.Errorf("sql.DB.Prepare: %v", err)
+	}
+	return &LockingStore[T]{
+		Store:      store,
+		lockStmt:   lockStmt,
+		unlockStmt: unlockStmt,
+		lockTTL:    o.lockTTL,
+	}, nil
+}
+
+// Lock polls the table {{table}}_lock until it takes the lock or ctx is done.
+// A lock expires after the duration set by [WithLockTTL] even if it is
+// not unlocked. Unlike other methods, Lock always uses the clock of the
+// application, as set by [WithClock] or time.Now.
+func (s *LockingStore[T]) Lock(ctx context.Context, id string) (unlock func(), err error) {
+	token := rand.Text()
+	now := time.Now
+	if s.clock != nil {
+		now = s.clock
+	}
+	for {
+		t := now()
+		res, err := s.lockStmt.ExecContext(ctx, id, token, rfc3339Nano(t.Add(s.lockTTL)), rfc3339Nano(t))
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+	return func() {
+		// The lock expires anyway if this fails.
+		s.unlockStmt.ExecContext(context.WithoutCancel(ctx), id, token)
+	}, nil
+}
@@ -1,8 +1,15 @@
 package sqlite3store
 
 import (
+	"context"
 	"database/sql"
 	"flag"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -45,19 +52,15 @@ func testDB(t testing.TB) *sql.DB {
 			t.Fatal(err)
 		}
 	}
-	if _, err := db.Exec(`
-	CREATE TABLE IF NOT EXISTS httpsession (
-       id TEXT NOT NULL PRIMARY KEY,
-       idle_deadline TEXT NOT NULL,
-       absolute_deadline TEXT NOT NULL,
-       data BLOB NOT NULL
-	);`); err != nil {
-		t.Fatal(err)
-	}
-	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS httpsession_idle_deadline_idx ON httpsession(idle_deadline)`); err != nil {
+	createTable(t, db, DefaultTable)
+	return db
+}
+
+func createTable(t testing.TB, db *sql.DB, table string) {
+	t.Helper()
+	if err := Migrate(t.Context(), db, WithTable(table)); err != nil {
 		t.Fatal(err)
 	}
-	return db
 }
 
 func testStore(t testing.TB) *Store[testSession] {
@@ -73,6 +76,77 @@ func testStore(t testing.TB) *Store[testSession] {
 	return store
 }
 
+func TestNewSessionStore(t *testing.T) {
+	var store *Store[testSession]
+	store, err := NewSessionStore[testSession](testDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store == nil {
+		t.Fatal("store = nil")
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+t.TempDir()+"/empty.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSessionStore[testSession](db); err == nil {
+		t.Error("expected error for a missing table")
+	}
+	defer func() {
+		msg, _ := recover().(string)
+		if !strings.HasPrefix(msg, "sqlite3store.New: ") {
+			t.Errorf("unexpected panic: %q", msg)
+		}
+	}()
+	New[testSession](db)
+}
+
+func TestWithTable(t *testing.T) {
+	ctx := t.Context()
+	db := testDB(t)
+	createTable(t, db, "app2")
+	store := New[testSession](db)
+	store2 := New[testSession](db, WithTable("app2"))
+	if err := store2.Save(ctx, recordNotExpired); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	if found, err := store2.Load(ctx, recordNotExpired.ID, &got); err != nil || !found {
+		t.Fatal(found, err)
+	}
+	if found, err := store.Load(ctx, recordNotExpired.ID, &got); err != nil || found {
+		t.Fatalf("found a record of another table: %v, %v", found, err)
+	}
+
+	for _, table := range []string{"", "1table", "a b", "t; DROP TABLE x", `"quoted"`, "main.app2"} {
+		if _, err := NewSessionStore[testSession](db, WithTable(table)); err == nil {
+			t.Errorf("%q: expected error", table)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := t.Context()
+	db := testDB(t)
+	// Migrate is idempotent.
+	if err := Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx,
+		`SELECT count(*) FROM sqlite_master WHERE type = 'index' AND name = 'httpsession_idle_deadline_idx'`,
+	).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %v indexes; want 1", n)
+	}
+	if err := Migrate(ctx, db, WithTable("a b")); err == nil {
+		t.Error("expected error for an invalid table name")
+	}
+}
+
 func TestLoad(t *testing.T) {
 	ctx := t.Context()
 	store := testStore(t)
@@ -118,6 +192,75 @@ func TestSave(t *testing.T) {
 	}
 }
 
+func TestSaveFlashes(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	record := *recordNotExpired
+	record.Flashes = []string{"a", "b"}
+	if err := store.Save(ctx, &record); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	if _, err := store.Load(ctx, record.ID, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Flashes, record.Flashes) {
+		t.Errorf("got %q; want %q", got.Flashes, record.Flashes)
+	}
+
+	record.Flashes = nil
+	if err := store.Save(ctx, &record); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(ctx, record.ID, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Flashes != nil {
+		t.Errorf("got %q; want nil", got.Flashes)
+	}
+}
+
+func TestSaveAbsoluteDeadline(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	record := *recordNotExpired
+	record.AbsoluteDeadline = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.Save(ctx, &record); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, record.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("record not found")
+	}
+	if !got.AbsoluteDeadline.Equal(record.AbsoluteDeadline) {
+		t.Errorf("got %v; want %v", got.AbsoluteDeadline, record.AbsoluteDeadline)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	deadline := time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.Touch(ctx, recordNotExpired.ID, deadline); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, recordNotExpired.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("record not found")
+	}
+	if !got.IdleDeadline.Equal(deadline) {
+		t.Errorf("got %v; want %v", got.IdleDeadline, deadline)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	ctx := t.Context()
 	store := testStore(t)
@@ -158,3 +301,384 @@ func TestDeleteExpired(t *testing.T) {
 		t.Error("record not found")
 	}
 }
+
+func TestDeleteExpiredBatch(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	for i := range 4 {
+		r := *recordExpired
+		r.ID = "expired" + strconv.Itoa(i)
+		if err := store.Save(ctx, &r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 5 expired records in total.
+	for _, want := range []int{2, 2, 1, 0} {
+		n, err := store.DeleteExpiredBatch(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("got %v deleted; want %v", n, want)
+		}
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, recordNotExpired.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("record not found")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	record := &httpsession.Record[testSession]{
+		ID:               "exporttest",
+		IdleDeadline:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		AbsoluteDeadline: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		Session:          testSession{N: 42},
+	}
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []*httpsession.Record[testSession]
+	err := store.Export(ctx, func(r *httpsession.Record[testSession]) error {
+		r2 := *r
+		records = append(records, &r2)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("exported %v records; want 2", len(records))
+	}
+
+	store2 := New[testSession](testDB(t))
+	if err := store2.Import(ctx, records); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []*httpsession.Record[testSession]{recordNotExpired, record} {
+		var got httpsession.Record[testSession]
+		found, err := store2.Load(ctx, want.ID, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("record %v not found", want.ID)
+		}
+		if got.Session != want.Session || !got.AbsoluteDeadline.Equal(want.AbsoluteDeadline) {
+			t.Errorf("got %+v; want %+v", got, want)
+		}
+	}
+	var got httpsession.Record[testSession]
+	if found, _ := store2.Load(ctx, recordExpired.ID, &got); found {
+		t.Error("expired record was exported")
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	ctx := t.Context()
+	tests := []struct {
+		now            time.Time
+		wantNotExpired bool
+		wantExpired    bool
+	}{
+		// The app clock is far behind the database clock.
+		{time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC), true, true},
+		// The app clock is far ahead of the database clock.
+		{time.Date(2101, 1, 1, 0, 0, 0, 0, time.UTC), false, false},
+	}
+	for _, tt := range tests {
+		db := testDB(t)
+		store := New[testSession](db, WithClock(func() time.Time { return tt.now }))
+		for _, r := range []*httpsession.Record[testSession]{recordNotExpired, recordExpired} {
+			if err := store.Save(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for id, want := range map[string]bool{recordNotExpired.ID: tt.wantNotExpired, recordExpired.ID: tt.wantExpired} {
+			var r httpsession.Record[testSession]
+			found, err := store.Load(ctx, id, &r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != want {
+				t.Errorf("now %v: Load(%q) = %v; want %v", tt.now, id, found, want)
+			}
+		}
+		if err := store.DeleteExpired(ctx); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if err := db.QueryRow(`SELECT count(*) FROM ` + DefaultTable).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{true: 2, false: 0}[tt.wantExpired]; n != want {
+			t.Errorf("now %v: %v records after DeleteExpired; want %v", tt.now, n, want)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	newSession := func() *httpsession.SessionStore[testSession] {
+		db, err := sql.Open("sqlite3", "file:"+dir+"/test.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		createTable(t, db, DefaultTable)
+		store, err := NewLockingStore[testSession](db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := httpsession.New[testSession]()
+		session.Store = store
+		return session
+	}
+	// Two processes share the database.
+	sessions := []*httpsession.SessionStore[testSession]{newSession(), newSession()}
+	var handlers []http.Handler
+	for _, session := range sessions {
+		handlers = append(handlers, session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s := session.Get(r.Context())
+			n := s.N
+			time.Sleep(time.Millisecond) // widen the window for lost updates
+			s.N = n + 1
+			w.Write(nil)
+		})))
+	}
+
+	w := httptest.NewRecorder()
+	handlers[0].ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookie := w.Result().Cookies()[0]
+
+	const perHandler = 10
+	var wg sync.WaitGroup
+	for _, h := range handlers {
+		for range perHandler {
+			wg.Go(func() {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.AddCookie(cookie)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					t.Errorf("got status %v", w.Code)
+				}
+			})
+		}
+	}
+	wg.Wait()
+
+	var record httpsession.Record[testSession]
+	found, err := sessions[0].Store.Load(t.Context(), cookie.Value, &record)
+	if err != nil || !found {
+		t.Fatal(found, err)
+	}
+	if want := 1 + len(handlers)*perHandler; record.Session.N != want {
+		t.Errorf("got N = %v; want %v", record.Session.N, want)
+	}
+}
+
+func TestLockTTL(t *testing.T) {
+	ctx := t.Context()
+	now := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	store, err := NewLockingStore[testSession](testDB(t), WithLockTTL(time.Minute), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Lock(ctx, "id"); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 5*lockRetryInterval)
+	defer cancel()
+	if _, err := store.Lock(timeout, "id"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+	// The lock expired without unlock.
+	now = now.Add(time.Minute)
+	unlock, err := store.Lock(ctx, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	unlock, err = store.Lock(ctx, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestStoreWithoutLockTable(t *testing.T) {
+	// A table created before the lock table was added to Migrate.
+	db, err := sql.Open("sqlite3", "file:"+t.TempDir()+"/old.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`CREATE TABLE httpsession (
+	id TEXT NOT NULL PRIMARY KEY,
+	idle_deadline TEXT NOT NULL,
+	absolute_deadline TEXT NOT NULL,
+	data BLOB NOT NULL,
+	flashes TEXT
+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := New[testSession](db)
+	if _, ok := any(store).(httpsession.Locker); ok {
+		t.Fatal("Store implements httpsession.Locker")
+	}
+	if _, err := NewLockingStore[testSession](db); err == nil {
+		t.Error("NewLockingStore: expected error for a missing lock table")
+	}
+
+	session := httpsession.New[testSession]()
+	session.Store = store
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %v; want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestMigrateAddsFlashes(t *testing.T) {
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", "file:"+t.TempDir()+"/old.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// A table created before flashes were stored.
+	_, err = db.Exec(`CREATE TABLE httpsession (
+	id TEXT NOT NULL PRIMARY KEY,
+	idle_deadline TEXT NOT NULL,
+	absolute_deadline TEXT NOT NULL,
+	data BLOB NOT NULL
+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The store works on it, except for saving flashes.
+	old, err := NewSessionStore[testSession](db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Save(ctx, recordNotExpired); err != nil {
+		t.Fatal(err)
+	}
+	var loaded httpsession.Record[testSession]
+	if found, err := old.Load(ctx, recordNotExpired.ID, &loaded); err != nil || !found {
+		t.Fatal(found, err)
+	}
+	if err := old.Export(ctx, func(*httpsession.Record[testSession]) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	withFlashes := *recordNotExpired
+	withFlashes.Flashes = []string{"hello"}
+	if err := old.Save(ctx, &withFlashes); err != errNoFlashesColumn {
+		t.Errorf("got %v; want %v", err, errNoFlashesColumn)
+	}
+
+	for range 2 {
+		if err := Migrate(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := NewSessionStore[testSession](db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := *recordNotExpired
+	r.Flashes = []string{"hello"}
+	if err := store.Save(ctx, &r); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	if found, err := store.Load(ctx, r.ID, &got); err != nil || !found {
+		t.Fatal(found, err)
+	}
+	if !slices.Equal(got.Flashes, r.Flashes) {
+		t.Errorf("got %q; want %q", got.Flashes, r.Flashes)
+	}
+}
+
+func TestQueryByJSONField(t *testing.T) {
+	type roleSession struct {
+		Role string
+		N    int
+	}
+	ctx := t.Context()
+	db := testDB(t)
+	createTable(t, db, DefaultTable)
+	store := New[roleSession](db)
+	deadline := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, r := range []*httpsession.Record[roleSession]{
+		{ID: "admin1", IdleDeadline: deadline, AbsoluteDeadline: deadline, Session: roleSession{Role: "admin", N: 1}},
+		{ID: "admin2", IdleDeadline: deadline, AbsoluteDeadline: deadline, Session: roleSession{Role: "admin", N: 2}},
+		{ID: "user", IdleDeadline: deadline, AbsoluteDeadline: deadline, Session: roleSession{Role: "user", N: 1}},
+		{ID: "expired", IdleDeadline: recordExpired.IdleDeadline, AbsoluteDeadline: deadline, Session: roleSession{Role: "admin"}},
+	} {
+		if err := store.Save(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path  string
+		value any
+		want  []string
+	}{
+		{"$.Role", "admin", []string{"admin1", "admin2"}},
+		{"$.N", 1, []string{"admin1", "user"}},
+		{"$.Role", "guest", nil},
+	}
+	for _, tt := range tests {
+		records, err := store.QueryByJSONField(ctx, tt.path, tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.ID)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("QueryByJSONField(%q, %v) = %v; want %v", tt.path, tt.value, got, tt.want)
+		}
+	}
+}
+
+var (
+	_ httpsession.TypeChecker  = (*Store[testSession])(nil)
+	_ httpsession.Toucher      = (*Store[testSession])(nil)
+	_ httpsession.Locker       = (*LockingStore[testSession])(nil)
+	_ httpsession.Toucher      = (*LockingStore[testSession])(nil)
+	_ httpsession.BatchDeleter = (*Store[testSession])(nil)
+)
+
+func TestCheckType(t *testing.T) {
+	if err := New[testSession](testDB(t)).CheckType(); err != nil {
+		t.Error(err)
+	}
+	type badSession struct {
+		F func()
+	}
+	if err := New[badSession](testDB(t)).CheckType(); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
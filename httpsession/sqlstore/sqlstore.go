@@ -0,0 +1,247 @@
+// Package sqlstore implements [httpsession.Store] on top of database/sql
+// for any database described by a [Dialect], e.g. SQLite, PostgreSQL and MySQL.
+//
+// The table must be created beforehand with columns like the following,
+// adjusting the types to the database:
+//
+//	CREATE TABLE httpsession (
+//		id VARCHAR(255) NOT NULL PRIMARY KEY,
+//		idle_deadline TIMESTAMP NOT NULL,
+//		absolute_deadline TIMESTAMP NOT NULL,
+//		data BLOB NOT NULL,
+//		flashes TEXT
+//	);
+//	CREATE INDEX httpsession_idle_deadline_idx ON httpsession(idle_deadline);
+//
+// Deadlines are written as [time.Time] in UTC, so the driver must be able to
+// store and scan them, e.g. with parseTime=true for MySQL.
+// Sessions without an absolute timeout have an absolute deadline of 9999-12-31,
+// so the deadline columns must hold dates up to then. In MySQL, declare them
+// DATETIME(6) rather than TIMESTAMP, which ends in 2038.
+// The package does not import a driver.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yhnw/tmp/httpsession"
+)
+
+// Dialect describes the SQL syntax that differs between databases.
+type Dialect struct {
+	// Placeholder returns the placeholder of the n-th parameter, counting from 1.
+	Placeholder func(n int) string
+	// Now is an expression of the current time in UTC
+	// that can be compared with the deadline columns.
+	Now string
+	// Upsert returns the clause appended to an INSERT statement
+	// that updates columns of an existing row with the inserted values.
+	Upsert func(columns []string) string
+}
+
+func questionMark(int) string { return "?" }
+
+func onConflict(columns []string) string {
+	set := make([]string, len(columns))
+	for i, c := range columns {
+		set[i] = c + " = excluded." + c
+	}
+	return "ON CONFLICT(id) DO UPDATE SET " + strings.Join(set, ", ")
+}
+
+// Predefined dialects.
+var (
+	// SQLite compares deadlines as text, which works with drivers that
+	// store time.Time in a "2006-01-02 15:04:05" layout such as github.com/mattn/go-sqlite3.
+	SQLite = Dialect{
+		Placeholder: questionMark,
+		Now:         "datetime('now')",
+		Upsert:      onConflict,
+	}
+	Postgres = Dialect{
+		Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		Now:         "now()",
+		Upsert:      onConflict,
+	}
+	MySQL = Dialect{
+		Placeholder: questionMark,
+		Now:         "UTC_TIMESTAMP(6)",
+		Upsert: func(columns []string) string {
+			set := make([]string, len(columns))
+			for i, c := range columns {
+				set[i] = c + " = VALUES(" + c + ")"
+			}
+			return "ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+		},
+	}
+)
+
+// DefaultTable is the default table name.
+const DefaultTable = "httpsession"
+
+type Store[T any] struct {
+	loadStmt          *sql.Stmt
+	saveStmt          *sql.Stmt
+	deleteStmt        *sql.Stmt
+	deleteExpiredStmt *sql.Stmt
+	touchStmt         *sql.Stmt
+}
+
+type options struct {
+	table string
+}
+
+// Option configures a [Store].
+type Option func(*options)
+
+// WithTable sets the name of the table that stores sessions.
+// The name may be qualified with a schema name, e.g. "app.httpsession".
+func WithTable(name string) Option {
+	return func(o *options) {
+		o.table = name
+	}
+}
+
+var identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// New returns a new [Store] for the database described by d.
+// It panics if the table name is invalid or a statement cannot be prepared.
+func New[T any](db *sql.DB, d Dialect, opts ...Option) *Store[T] {
+	o := options{table: DefaultTable}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !identRegexp.MatchString(o.table) {
+		panic(fmt.Sprintf("sqlstore.New: invalid table name %q", o.table))
+	}
+	q := d.queries(o.table)
+	loadStmt, err1 := db.Prepare(q.load)
+	saveStmt, err2 := db.Prepare(q.save)
+	deleteStmt, err3 := db.Prepare(q.delete)
+	deleteExpiredStmt, err4 := db.Prepare(q.deleteExpired)
+	touchStmt, err5 := db.Prepare(q.touch)
+	if err := errors.Join(err1, err2, err3, err4, err5); err != nil {
+		panic(fmt.Sprintf("sqlstore.New: sql.DB.Prepare: %v", err))
+	}
+	return &Store[T]{loadStmt, saveStmt, deleteStmt, deleteExpiredStmt, touchStmt}
+}
+
+type queries struct {
+	load, save, delete, deleteExpired, touch string
+}
+
+func (d Dialect) queries(table string) queries {
+	p := d.Placeholder
+	return queries{
+		load: fmt.Sprintf(`
+SELECT
+	id,
+	idle_deadline,
+	absolute_deadline,
+	data,
+	flashes
+FROM
+	%s
+WHERE
+	id = %s AND idle_deadline > %s`, table, p(1), d.Now),
+		save: fmt.Sprintf(`
+INSERT INTO %s (
+	id, idle_deadline, absolute_deadline, data, flashes
+) VALUES (%s, %s, %s, %s, %s)
+%s`, table, p(1), p(2), p(3), p(4), p(5),
+			d.Upsert([]string{"idle_deadline", "absolute_deadline", "data", "flashes"})),
+		delete:        fmt.Sprintf(`DELETE FROM %s WHERE id = %s`, table, p(1)),
+		deleteExpired: fmt.Sprintf(`DELETE FROM %s WHERE idle_deadline <= %s`, table, d.Now),
+		touch:         fmt.Sprintf(`UPDATE %s SET idle_deadline = %s WHERE id = %s`, table, p(1), p(2)),
+	}
+}
+
+// flashes stores httpsession.Record.Flashes as a JSON array, or NULL if empty.
+type flashes []string
+
+func (f *flashes) Scan(src any) error {
+	*f = nil
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), (*[]string)(f))
+	case []byte:
+		return json.Unmarshal(v, (*[]string)(f))
+	default:
+		return fmt.Errorf("sqlstore: cannot scan to []string: (%#v, %T)", src, src)
+	}
+}
+
+func (f flashes) Value() (driver.Value, error) {
+	if len(f) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal([]string(f))
+	return string(b), err
+}
+
+// CheckType reports whether T can be encoded in JSON.
+func (s *Store[T]) CheckType() error {
+	var zero T
+	_, err := json.Marshal(zero)
+	return err
+}
+
+func (s *Store[T]) Load(ctx context.Context, id string, r *httpsession.Record[T]) (bool, error) {
+	var buf []byte
+	err := s.loadStmt.QueryRowContext(ctx, id).Scan(
+		&r.ID,
+		&r.IdleDeadline,
+		&r.AbsoluteDeadline,
+		&buf,
+		(*flashes)(&r.Flashes),
+	)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(buf, &r.Session)
+}
+
+func (s *Store[T]) Save(ctx context.Context, r *httpsession.Record[T]) error {
+	buf, err := json.Marshal(r.Session)
+	if err != nil {
+		return err
+	}
+	_, err = s.saveStmt.ExecContext(ctx,
+		r.ID,
+		r.IdleDeadline.UTC(),
+		r.AbsoluteDeadline.UTC(),
+		buf,
+		flashes(r.Flashes),
+	)
+	return err
+}
+
+// Touch updates idle_deadline of a session record associated with id
+// without rewriting data.
+func (s *Store[T]) Touch(ctx context.Context, id string, idleDeadline time.Time) error {
+	_, err := s.touchStmt.ExecContext(ctx, idleDeadline.UTC(), id)
+	return err
+}
+
+func (s *Store[T]) Delete(ctx context.Context, id string) error {
+	_, err := s.deleteStmt.ExecContext(ctx, id)
+	return err
+}
+
+func (s *Store[T]) DeleteExpired(ctx context.Context) error {
+	_, err := s.deleteExpiredStmt.ExecContext(ctx)
+	return err
+}
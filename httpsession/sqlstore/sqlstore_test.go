@@ -0,0 +1,200 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yhnw/tmp/httpsession"
+)
+
+type testSession struct {
+	N int
+}
+
+var (
+	recordNotExpired = &httpsession.Record[testSession]{
+		ID:               "notexpired",
+		IdleDeadline:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		AbsoluteDeadline: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	recordExpired = &httpsession.Record[testSession]{
+		ID:               "expired",
+		IdleDeadline:     time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		AbsoluteDeadline: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+)
+
+func testStore(t *testing.T, opts ...Option) *Store[testSession] {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+t.TempDir()+"/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	o := options{table: DefaultTable}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if _, err := db.Exec(`
+	CREATE TABLE ` + o.table + ` (
+		id TEXT NOT NULL PRIMARY KEY,
+		idle_deadline TIMESTAMP NOT NULL,
+		absolute_deadline TIMESTAMP NOT NULL,
+		data BLOB NOT NULL,
+		flashes TEXT
+	);`); err != nil {
+		t.Fatal(err)
+	}
+	store := New[testSession](db, SQLite, opts...)
+	if err := store.Save(t.Context(), recordNotExpired); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(t.Context(), recordExpired); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestQueries(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		save    string
+		load    string
+	}{
+		{SQLite, "VALUES (?, ?, ?, ?, ?)\nON CONFLICT(id) DO UPDATE SET idle_deadline = excluded.idle_deadline", "id = ? AND idle_deadline > datetime('now')"},
+		{Postgres, "VALUES ($1, $2, $3, $4, $5)\nON CONFLICT(id) DO UPDATE SET idle_deadline = excluded.idle_deadline", "id = $1 AND idle_deadline > now()"},
+		{MySQL, "VALUES (?, ?, ?, ?, ?)\nON DUPLICATE KEY UPDATE idle_deadline = VALUES(idle_deadline)", "id = ? AND idle_deadline > UTC_TIMESTAMP(6)"},
+	}
+	for _, tt := range tests {
+		q := tt.dialect.queries("app.sessions")
+		if !strings.Contains(q.save, "INSERT INTO app.sessions") || !strings.Contains(q.save, tt.save) {
+			t.Errorf("got save query %q; want it to contain %q", q.save, tt.save)
+		}
+		if !strings.Contains(q.load, tt.load) {
+			t.Errorf("got load query %q; want it to contain %q", q.load, tt.load)
+		}
+	}
+}
+
+func TestInvalidTable(t *testing.T) {
+	for _, table := range []string{"", "1table", "a b", "t; DROP TABLE x", `"quoted"`, "a.b.c"} {
+		t.Run("", func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: want panic", table)
+				}
+			}()
+			New[testSession](nil, SQLite, WithTable(table))
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	var record httpsession.Record[testSession]
+	found, err := store.Load(ctx, recordNotExpired.ID, &record)
+	if err != nil || !found {
+		t.Fatal(found, err)
+	}
+	if !record.IdleDeadline.Equal(recordNotExpired.IdleDeadline) {
+		t.Errorf("got %v; want %v", record.IdleDeadline, recordNotExpired.IdleDeadline)
+	}
+	found, err = store.Load(ctx, recordExpired.ID, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Errorf("unexpected record %#v", record)
+	}
+}
+
+func TestSave(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t, WithTable("httpsession_test"))
+	record := &httpsession.Record[testSession]{
+		ID:               "savetest",
+		IdleDeadline:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		AbsoluteDeadline: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		Session:          testSession{N: 1},
+	}
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+	record.AbsoluteDeadline = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+	record.Session.N = 2
+	record.Flashes = []string{"a", "b"}
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, record.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("record not found")
+	}
+	if got.Session != record.Session || !got.AbsoluteDeadline.Equal(record.AbsoluteDeadline) || !slices.Equal(got.Flashes, record.Flashes) {
+		t.Errorf("got %+v; want %+v", got, record)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	deadline := time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.Touch(ctx, recordNotExpired.ID, deadline); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	if found, err := store.Load(ctx, recordNotExpired.ID, &got); err != nil || !found {
+		t.Fatal(found, err)
+	}
+	if !got.IdleDeadline.Equal(deadline) {
+		t.Errorf("got %v; want %v", got.IdleDeadline, deadline)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	if err := store.Delete(ctx, recordNotExpired.ID); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, recordNotExpired.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("record found")
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	ctx := t.Context()
+	store := testStore(t)
+	if err := store.DeleteExpired(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var got httpsession.Record[testSession]
+	found, err := store.Load(ctx, recordExpired.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expired record found")
+	}
+	found, err = store.Load(ctx, recordNotExpired.ID, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("record not found")
+	}
+}
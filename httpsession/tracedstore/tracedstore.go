@@ -0,0 +1,124 @@
+// Package tracedstore implements [httpsession.Store] that traces calls to
+// another store, e.g. to show them as child spans of a request in
+// distributed tracing.
+//
+// The package does not depend on a tracing library; a [Tracer] for
+// OpenTelemetry can be written as:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, func(error)) {
+//		ctx, span := t.Tracer.Start(ctx, name)
+//		return ctx, func(err error) {
+//			if err != nil {
+//				span.RecordError(err)
+//				span.SetStatus(codes.Error, err.Error())
+//			}
+//			span.End()
+//		}
+//	}
+package tracedstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/yhnw/tmp/httpsession"
+)
+
+// Tracer starts spans around calls to a store.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, if any,
+	// and returns a context that carries it and a function that ends it.
+	// err passed to end is the error returned by the call, or nil.
+	Start(ctx context.Context, name string) (_ context.Context, end func(err error))
+}
+
+// Store is a [httpsession.Store] that starts a span with Tracer around
+// each call to Inner. Spans are named after the method, e.g.
+// "httpsession.Store.Load"; session IDs are not recorded, since they are
+// credentials.
+//
+// Store implements [httpsession.Aliaser], [httpsession.Locker] and
+// [httpsession.BatchDeleter] whether or not Inner does, and falls back to
+// what [httpsession.SessionStore] does without them if Inner does not.
+// It does not implement [httpsession.Toucher], so sessions are always
+// saved with Save.
+type Store[T any] struct {
+	Inner  httpsession.Store[T]
+	Tracer Tracer
+}
+
+// New returns a new [Store] that traces calls to inner with tracer.
+func New[T any](inner httpsession.Store[T], tracer Tracer) *Store[T] {
+	return &Store[T]{Inner: inner, Tracer: tracer}
+}
+
+func (s *Store[T]) Load(ctx context.Context, id string, ret *httpsession.Record[T]) (found bool, err error) {
+	ctx, end := s.Tracer.Start(ctx, "httpsession.Store.Load")
+	defer func() { end(err) }()
+	return s.Inner.Load(ctx, id, ret)
+}
+
+func (s *Store[T]) Save(ctx context.Context, r *httpsession.Record[T]) (err error) {
+	ctx, end := s.Tracer.Start(ctx, "httpsession.Store.Save")
+	defer func() { end(err) }()
+	return s.Inner.Save(ctx, r)
+}
+
+func (s *Store[T]) Delete(ctx context.Context, id string) (err error) {
+	ctx, end := s.Tracer.Start(ctx, "httpsession.Store.Delete")
+	defer func() { end(err) }()
+	return s.Inner.Delete(ctx, id)
+}
+
+func (s *Store[T]) DeleteExpired(ctx context.Context) (err error) {
+	ctx, end := s.Tracer.Start(ctx, "httpsession.Store.DeleteExpired")
+	defer func() { end(err) }()
+	return s.Inner.DeleteExpired(ctx)
+}
+
+// Alias calls Alias of Inner, or Delete of Inner with oldID
+// if Inner does not implement [httpsession.Aliaser].
+func (s *Store[T]) Alias(ctx context.Context, oldID, newID string, deadline time.Time) (err error) {
+	a, ok := s.Inner.(httpsession.Aliaser)
+	if !ok {
+		return s.Delete(ctx, oldID)
+	}
+	ctx, end := s.Tracer.Start(ctx, "httpsession.Store.Alias")
+	defer func() { end(err) }()
+	return a.Alias(ctx, oldID, newID, deadline)
+}
+
+// Lock calls Lock of Inner, or does nothing
+// if Inner does not implement [httpsession.Locker].
+// The span ends when the lock is acquired, not when it is released.
+func (s *Store[T]) Lock(ctx context.Context, id string) (unlock func(), err error) {
+	l, ok := s.Inner.(httpsession.Locker)
+	if !ok {
+		return func() {}, nil
+	}
+	ctx, end := s.Tracer.Start(ctx, "httpsession.Store.Lock")
+	defer func() { end(err) }()
+	return l.Lock(ctx, id)
+}
+
+// DeleteExpiredBatch calls DeleteExpiredBatch of Inner, or DeleteExpired of
+// Inner and returns 0 if Inner does not implement [httpsession.BatchDeleter].
+func (s *Store[T]) DeleteExpiredBatch(ctx context.Context, limit int) (deleted int, err error) {
+	b, ok := s.Inner.(httpsession.BatchDeleter)
+	if !ok {
+		return 0, s.DeleteExpired(ctx)
+	}
+	ctx, end := s.Tracer.Start(ctx, "httpsession.Store.DeleteExpiredBatch")
+	defer func() { end(err) }()
+	return b.DeleteExpiredBatch(ctx, limit)
+}
+
+// CheckType calls CheckType of Inner if it implements [httpsession.TypeChecker].
+func (s *Store[T]) CheckType() error {
+	if c, ok := s.Inner.(httpsession.TypeChecker); ok {
+		return c.CheckType()
+	}
+	return nil
+}
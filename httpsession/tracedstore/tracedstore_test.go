@@ -0,0 +1,177 @@
+package tracedstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/yhnw/tmp/httpsession"
+)
+
+type testSession struct {
+	N int
+}
+
+type requestKey struct{}
+
+type spanKey struct{}
+
+// recordingTracer records spans as "name" or "name: error",
+// and whether they were started with the context of a request.
+type recordingTracer struct {
+	spans    []string
+	orphaned int
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, func(error)) {
+	if ctx.Value(requestKey{}) == nil {
+		t.orphaned++
+	}
+	return context.WithValue(ctx, spanKey{}, name), func(err error) {
+		if err != nil {
+			name += ": " + err.Error()
+		}
+		t.spans = append(t.spans, name)
+	}
+}
+
+func TestStore(t *testing.T) {
+	tracer := new(recordingTracer)
+	inner := httpsession.NewMemoryStore[testSession]()
+	var innerSpans []any
+	session := httpsession.New[testSession]()
+	session.Store = New(&ctxStore[testSession]{Store: inner, spans: &innerSpans}, tracer)
+	h := session.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/renew":
+			if err := session.Renew(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+		case "/delete":
+			if err := session.Delete(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		session.Get(r.Context()).N++
+		w.Write(nil)
+	}))
+	withRequest := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestKey{}, true)))
+		})
+	}(h)
+
+	var cookie *http.Cookie
+	for _, target := range []string{"/", "/renew", "/delete"} {
+		r := httptest.NewRequest("GET", target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		withRequest.ServeHTTP(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+	}
+
+	want := []string{
+		"httpsession.Store.Save",
+		"httpsession.Store.Load", "httpsession.Store.Delete", "httpsession.Store.Save",
+		"httpsession.Store.Load", "httpsession.Store.Delete",
+	}
+	if !slices.Equal(tracer.spans, want) {
+		t.Errorf("got spans %q;\nwant %q", tracer.spans, want)
+	}
+	if tracer.orphaned != 0 {
+		t.Errorf("got %v spans without the request context", tracer.orphaned)
+	}
+	// Inner is called with the context of the span.
+	for i, span := range innerSpans {
+		if span != tracer.spans[i] {
+			t.Errorf("Inner call %d: got span %v; want %v", i, span, tracer.spans[i])
+		}
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	tracer := new(recordingTracer)
+	errDown := errors.New("down")
+	s := New[testSession](failingStore[testSession]{errDown}, tracer)
+	ctx := context.WithValue(t.Context(), requestKey{}, true)
+	if _, err := s.Load(ctx, "id", new(httpsession.Record[testSession])); err != errDown {
+		t.Errorf("got %v; want %v", err, errDown)
+	}
+	if want := []string{"httpsession.Store.Load: down"}; !slices.Equal(tracer.spans, want) {
+		t.Errorf("got spans %q; want %q", tracer.spans, want)
+	}
+}
+
+func TestStoreFallback(t *testing.T) {
+	tracer := new(recordingTracer)
+	s := New[testSession](failingStore[testSession]{}, tracer)
+	ctx := context.WithValue(t.Context(), requestKey{}, true)
+	unlock, err := s.Lock(ctx, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if n, err := s.DeleteExpiredBatch(ctx, 10); n != 0 || err != nil {
+		t.Errorf("DeleteExpiredBatch() = %v, %v; want 0, nil", n, err)
+	}
+	if err := s.Alias(ctx, "old", "new", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"httpsession.Store.DeleteExpired", "httpsession.Store.Delete"}
+	if !slices.Equal(tracer.spans, want) {
+		t.Errorf("got spans %q; want %q", tracer.spans, want)
+	}
+}
+
+// ctxStore records the span in the context of each call.
+type ctxStore[T any] struct {
+	httpsession.Store[T]
+	spans *[]any
+}
+
+func (s *ctxStore[T]) Load(ctx context.Context, id string, ret *httpsession.Record[T]) (bool, error) {
+	*s.spans = append(*s.spans, ctx.Value(spanKey{}))
+	return s.Store.Load(ctx, id, ret)
+}
+
+func (s *ctxStore[T]) Save(ctx context.Context, r *httpsession.Record[T]) error {
+	*s.spans = append(*s.spans, ctx.Value(spanKey{}))
+	return s.Store.Save(ctx, r)
+}
+
+func (s *ctxStore[T]) Delete(ctx context.Context, id string) error {
+	*s.spans = append(*s.spans, ctx.Value(spanKey{}))
+	return s.Store.Delete(ctx, id)
+}
+
+// failingStore returns err from every method.
+type failingStore[T any] struct {
+	err error
+}
+
+func (s failingStore[T]) Load(context.Context, string, *httpsession.Record[T]) (bool, error) {
+	return false, s.err
+}
+
+func (s failingStore[T]) Save(context.Context, *httpsession.Record[T]) error { return s.err }
+
+func (s failingStore[T]) Delete(context.Context, string) error { return s.err }
+
+func (s failingStore[T]) DeleteExpired(context.Context) error { return s.err }
+
+var (
+	_ httpsession.Store[testSession] = (*Store[testSession])(nil)
+	_ httpsession.TypeChecker        = (*Store[testSession])(nil)
+	_ httpsession.Aliaser            = (*Store[testSession])(nil)
+	_ httpsession.Locker             = (*Store[testSession])(nil)
+	_ httpsession.BatchDeleter       = (*Store[testSession])(nil)
+)
@@ -1,12 +1,75 @@
 package util
 
-import "strings"
+import (
+	"iter"
+	"strings"
+	"unicode/utf8"
+)
 
+// CutAny slices b around the first instance of any of the Unicode code
+// points in chars, returning the text before and after it.
+// If none of chars appears in b, CutAny returns b, zero, false.
 func CutAny[T ~string | ~[]byte](b T, chars T) (before, after T, ok bool) {
 	s := string(b)
 	i := strings.IndexAny(s, string(chars))
 	if i < 0 {
 		return b, after, false
 	}
-	return T(s[:i]), T(strings.TrimLeft(s, string(chars))), true
+	_, n := utf8.DecodeRuneInString(s[i:])
+	return T(s[:i]), T(s[i+n:]), true
+}
+
+// CutAnyLast is like [CutAny] but slices b around the last instance of
+// any of the Unicode code points in chars.
+func CutAnyLast[T ~string | ~[]byte](b T, chars T) (before, after T, ok bool) {
+	s := string(b)
+	i := strings.LastIndexAny(s, string(chars))
+	if i < 0 {
+		return b, after, false
+	}
+	_, n := utf8.DecodeRuneInString(s[i:])
+	return T(s[:i]), T(s[i+n:]), true
+}
+
+// SplitAny returns an iterator over the substrings of b separated by any of
+// the Unicode code points in chars, like [strings.SplitSeq] with a set of
+// separators. Adjacent separators yield empty substrings.
+// If none of chars appears in b, the iterator yields b alone.
+// The substrings are slices of b; b is not copied.
+func SplitAny[T ~string | ~[]byte](b T, chars T) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		set := string(chars)
+		for {
+			i, n := indexAny(b, set)
+			if i < 0 {
+				yield(b)
+				return
+			}
+			if !yield(b[:i]) {
+				return
+			}
+			b = b[i+n:]
+		}
+	}
+}
+
+// indexAny is like [strings.IndexAny] but also returns the length of
+// the matching code point, and it does not convert b to a string.
+func indexAny[T ~string | ~[]byte](b T, chars string) (i, n int) {
+	for i := 0; i < len(b); i += n {
+		if c := b[i]; c < utf8.RuneSelf {
+			if strings.IndexByte(chars, c) >= 0 {
+				return i, 1
+			}
+			n = 1
+			continue
+		}
+		// A conversion this short does not allocate.
+		var r rune
+		r, n = utf8.DecodeRuneInString(string(b[i:min(i+utf8.UTFMax, len(b))]))
+		if strings.ContainsRune(chars, r) {
+			return i, n
+		}
+	}
+	return -1, 0
 }
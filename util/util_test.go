@@ -0,0 +1,114 @@
+package util
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCutAny(t *testing.T) {
+	for _, tt := range []struct {
+		s, chars      string
+		before, after string
+		ok            bool
+	}{
+		{"a,b,c", ",", "a", "b,c", true},
+		{",a,b", ",", "", "a,b", true},
+		{",,a", ",", "", ",a", true},
+		{"a,", ",", "a", "", true},
+		{"abc", ",", "abc", "", false},
+		{"", ",", "", "", false},
+		{"abc", "", "abc", "", false},
+		{"a=b;c", ";=", "a", "b;c", true},
+		{"a;b=c", ";=", "a", "b=c", true},
+		{"a→b", "→", "a", "b", true},
+	} {
+		before, after, ok := CutAny(tt.s, tt.chars)
+		if before != tt.before || after != tt.after || ok != tt.ok {
+			t.Errorf("CutAny(%q, %q) = %q, %q, %v; want %q, %q, %v",
+				tt.s, tt.chars, before, after, ok, tt.before, tt.after, tt.ok)
+		}
+		bb, ba, ok := CutAny([]byte(tt.s), []byte(tt.chars))
+		if string(bb) != tt.before || string(ba) != tt.after || ok != tt.ok {
+			t.Errorf("CutAny([]byte(%q), []byte(%q)) = %q, %q, %v; want %q, %q, %v",
+				tt.s, tt.chars, bb, ba, ok, tt.before, tt.after, tt.ok)
+		}
+	}
+}
+
+func TestCutAnyLast(t *testing.T) {
+	for _, tt := range []struct {
+		s, chars      string
+		before, after string
+		ok            bool
+	}{
+		{"a,b,c", ",", "a,b", "c", true},
+		{"dir/file.tar.gz", ".", "dir/file.tar", "gz", true},
+		{"a/b\\c", "/\\", "a/b", "c", true},
+		{"a\\b/c", "/\\", "a\\b", "c", true},
+		{"a,", ",", "a", "", true},
+		{",a", ",", "", "a", true},
+		{"abc", ",", "abc", "", false},
+		{"", ",", "", "", false},
+		{"a→b→c", "→", "a→b", "c", true},
+	} {
+		before, after, ok := CutAnyLast(tt.s, tt.chars)
+		if before != tt.before || after != tt.after || ok != tt.ok {
+			t.Errorf("CutAnyLast(%q, %q) = %q, %q, %v; want %q, %q, %v",
+				tt.s, tt.chars, before, after, ok, tt.before, tt.after, tt.ok)
+		}
+		bb, ba, ok := CutAnyLast([]byte(tt.s), []byte(tt.chars))
+		if string(bb) != tt.before || string(ba) != tt.after || ok != tt.ok {
+			t.Errorf("CutAnyLast([]byte(%q), []byte(%q)) = %q, %q, %v; want %q, %q, %v",
+				tt.s, tt.chars, bb, ba, ok, tt.before, tt.after, tt.ok)
+		}
+	}
+}
+
+func TestSplitAny(t *testing.T) {
+	for _, tt := range []struct {
+		s, chars string
+		want     []string
+	}{
+		{"a,b;c", ",;", []string{"a", "b", "c"}},
+		{"a,,b", ",", []string{"a", "", "b"}},
+		{",a,", ",", []string{"", "a", ""}},
+		{"abc", ",", []string{"abc"}},
+		{"", ",", []string{""}},
+		{"a→b", "→", []string{"a", "b"}},
+		{"a→b=c", "=", []string{"a→b", "c"}},
+		{"é,è", "è,", []string{"é", "", ""}},
+	} {
+		if got := slices.Collect(SplitAny(tt.s, tt.chars)); !slices.Equal(got, tt.want) {
+			t.Errorf("SplitAny(%q, %q) = %q; want %q", tt.s, tt.chars, got, tt.want)
+		}
+		var got []string
+		for b := range SplitAny([]byte(tt.s), []byte(tt.chars)) {
+			got = append(got, string(b))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("SplitAny([]byte(%q), []byte(%q)) = %q; want %q", tt.s, tt.chars, got, tt.want)
+		}
+	}
+
+	// Stops when yield returns false.
+	var got []string
+	for s := range SplitAny("a,b,c", ",") {
+		got = append(got, s)
+		if s == "b" {
+			break
+		}
+	}
+	if want := []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func BenchmarkSplitAny(b *testing.B) {
+	data := []byte(strings.Repeat("field,", 10000))
+	b.ReportAllocs()
+	for b.Loop() {
+		for range SplitAny(data, []byte(",;")) {
+		}
+	}
+}